@@ -0,0 +1,210 @@
+package features
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SupportsCaddy returns whether the plugin can be built with the
+// given version (tag) of Caddy, according to its Caddy range.
+// Plugins without a range support every version, and every plugin
+// supports the empty version, which is whatever Caddy is on disk.
+func (p Plugin) SupportsCaddy(version string) bool {
+	if p.Caddy == "" || version == "" {
+		return true
+	}
+	constraints, err := parseRange(p.Caddy)
+	if err != nil {
+		return false
+	}
+	v, ok := parseSemver(version)
+	if !ok {
+		return false
+	}
+	for _, c := range constraints {
+		if !c.allows(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// ForCaddy returns the plugins in p that can be
+// built with the given version of Caddy.
+func (p Plugins) ForCaddy(version string) Plugins {
+	var plugins Plugins
+	for _, plug := range p {
+		if plug.SupportsCaddy(version) {
+			plugins = append(plugins, plug)
+		}
+	}
+	return plugins
+}
+
+// IsSemver returns whether version is a semantic version
+// like "v0.9.0", "0.9" or "v0.9.0-beta.1", which are the
+// only versions that Caddy ranges can be checked against.
+func IsSemver(version string) bool {
+	_, ok := parseSemver(version)
+	return ok
+}
+
+// semver is a parsed semantic version.
+type semver struct {
+	major, minor, patch int
+	pre                 []string // pre-release identifiers, like "beta", "1"
+}
+
+// parseSemver parses a semantic version. The "v" prefix and
+// the minor and patch numbers are optional. Build metadata
+// (after a "+") is checked, since versions end up in file
+// names, but otherwise ignored.
+func parseSemver(s string) (semver, bool) {
+	var v semver
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.Index(s, "+"); i > -1 {
+		if !validIdentifiers(s[i+1:]) {
+			return v, false
+		}
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i > -1 {
+		if !validIdentifiers(s[i+1:]) {
+			return v, false
+		}
+		s, v.pre = s[:i], strings.Split(s[i+1:], ".")
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, false
+	}
+	nums := []*int{&v.major, &v.minor, &v.patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part != strconv.Itoa(n) {
+			return v, false
+		}
+		*nums[i] = n
+	}
+	return v, true
+}
+
+// validIdentifiers returns whether s is a non-empty list of
+// dot-separated, non-empty identifiers of [0-9A-Za-z-].
+func validIdentifiers(s string) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, c := range id {
+			if !(c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compare returns -1, 0 or 1 if v is less than, equal to
+// or greater than w. A pre-release is less than its release.
+// Pre-releases of the same version are compared identifier by
+// identifier: numbers numerically and below words, which are
+// compared as strings; if all are equal, more identifiers win.
+func (v semver) compare(w semver) int {
+	for _, d := range []int{v.major - w.major, v.minor - w.minor, v.patch - w.patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(w.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(w.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(w.pre); i++ {
+		if c := compareIdentifiers(v.pre[i], w.pre[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) < len(w.pre):
+		return -1
+	case len(v.pre) > len(w.pre):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifiers compares two pre-release identifiers.
+func compareIdentifiers(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// constraint is one comparison of a Caddy range, like ">=0.9".
+type constraint struct {
+	op      string
+	version semver
+}
+
+// allows returns whether v satisfies c.
+func (c constraint) allows(v semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// parseRange parses a range of versions: comma-separated
+// comparisons that all have to hold, like ">=0.9, <0.10".
+// The operators are <, <=, >, >= and =, which is the default.
+func parseRange(r string) ([]constraint, error) {
+	var constraints []constraint
+	for _, field := range strings.Split(r, ",") {
+		field = strings.TrimSpace(field)
+		var c constraint
+		for _, op := range []string{"<=", ">=", "<", ">", "="} {
+			if strings.HasPrefix(field, op) {
+				c.op = op
+				field = strings.TrimSpace(field[len(op):])
+				break
+			}
+		}
+		v, ok := parseSemver(field)
+		if !ok {
+			return nil, fmt.Errorf("bad version '%s' in range '%s'", field, r)
+		}
+		c.version = v
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
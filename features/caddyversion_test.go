@@ -0,0 +1,86 @@
+package features
+
+import "testing"
+
+func TestSupportsCaddy(t *testing.T) {
+	for i, test := range []struct {
+		caddyRange string
+		version    string
+		expected   bool
+	}{
+		{"", "v0.9.0", true},
+		{">=0.9", "", true},
+		{">=0.9", "v0.9.0", true},
+		{">=0.9", "v0.8.3", false},
+		{">=0.9, <0.10", "v0.9.5", true},
+		{">=0.9, <0.10", "v0.10.0", false},
+		{">=0.9.0", "v0.9.0-beta.1", false},
+		{"<0.9.0", "v0.9.0-beta.1", true},
+		{"0.8.3", "v0.8.3", true},
+		{"=0.8.3", "v0.8.4", false},
+		{">0.8", "v0.8.1", true},
+		{"<=0.8", "v0.8.0", true},
+		{">=0.9", "master", false},
+	} {
+		plugin := Plugin{Caddy: test.caddyRange}
+		if actual := plugin.SupportsCaddy(test.version); actual != test.expected {
+			t.Errorf("Test %d: Expected %v for '%s' in '%s', got %v", i, test.expected, test.version, test.caddyRange, actual)
+		}
+	}
+}
+
+func TestIsSemver(t *testing.T) {
+	for i, test := range []struct {
+		version  string
+		expected bool
+	}{
+		{"v0.9.0", true},
+		{"0.9", true},
+		{"1", true},
+		{"v0.9.0-beta.1", true},
+		{"v0.9.0+build", true},
+		{"v0.9.0-", false},
+		{"v0.9.0-beta..1", false},
+		{"v0.9.0-beta/1", false},
+		{"v0.9.0-beta 1", false},
+		{"v0.9.0+build/../x", false},
+		{"v0.9.0-rc-1.x-y", true},
+		{"v0.9.0.1", false},
+		{"v01.9", false},
+		{"master", false},
+		{"", false},
+	} {
+		if actual := IsSemver(test.version); actual != test.expected {
+			t.Errorf("Test %d: Expected %v for '%s', got %v", i, test.expected, test.version, actual)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	for i, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"v0.9.0", "v0.9.0", 0},
+		{"v0.9", "v0.9.0", 0},
+		{"v0.9.0+a", "v0.9.0+b", 0},
+		{"v0.10.0", "v0.9.0", 1},
+		{"v0.9.0-beta.1", "v0.9.0", -1},
+		{"v0.9.0-beta.9", "v0.9.0-beta.10", -1},
+		{"v0.9.0-beta.10", "v0.9.0-beta.9", 1},
+		{"v0.9.0-alpha", "v0.9.0-alpha.1", -1},
+		{"v0.9.0-alpha.1", "v0.9.0-alpha.beta", -1},
+		{"v0.9.0-alpha.beta", "v0.9.0-beta", -1},
+		{"v0.9.0-beta.11", "v0.9.0-rc.1", -1},
+		{"v0.9.0-rc.1", "v0.9.0-rc.1", 0},
+	} {
+		a, okA := parseSemver(test.a)
+		b, okB := parseSemver(test.b)
+		if !okA || !okB {
+			t.Fatalf("Test %d: Expected valid versions, got '%s' (%v) and '%s' (%v)", i, test.a, okA, test.b, okB)
+		}
+		if actual := a.compare(b); actual != test.expected {
+			t.Errorf("Test %d: Expected %d comparing '%s' to '%s', got %d", i, test.expected, test.a, test.b, actual)
+		}
+	}
+}
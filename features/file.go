@@ -0,0 +1,138 @@
+package features
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	current      = Registry // the plugins in use right now
+	currentMutex sync.RWMutex
+)
+
+// Current returns the plugins currently registered. Unless
+// a registry file has been loaded, this is Registry. The
+// returned list must not be modified.
+func Current() Plugins {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	return current
+}
+
+// LoadFile reads a list of plugins from the JSON file at
+// path, validates it, and makes it the current registry.
+// If there is any error, the current registry is kept.
+func LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var plugins Plugins
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&plugins)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	err = plugins.Validate()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	Set(plugins)
+	return nil
+}
+
+// Set makes plugins the current registry. It
+// should be valid; see Plugins.Validate.
+func Set(plugins Plugins) {
+	currentMutex.Lock()
+	current = plugins
+	currentMutex.Unlock()
+}
+
+// Watch reloads the registry from the file at path whenever
+// its modification time changes, checking every interval. It
+// never returns. After each reload, reloaded is called with
+// the error, if any; if the file can't be loaded, the current
+// registry is kept.
+func Watch(path string, interval time.Duration, reloaded func(error)) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+	for {
+		time.Sleep(interval)
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+		reloaded(LoadFile(path))
+	}
+}
+
+// Validate makes sure every plugin in p is complete, that
+// no two plugins have the same name, that plugins only
+// require or conflict with other plugins in p, and that
+// platform patterns and Caddy ranges are well-formed.
+func (p Plugins) Validate() error {
+	if len(p) == 0 {
+		return fmt.Errorf("no plugins")
+	}
+	seen := make(map[string]bool)
+	for i, plug := range p {
+		if plug.Name == "" {
+			return fmt.Errorf("plugin %d: missing name", i)
+		}
+		if seen[plug.Name] {
+			return fmt.Errorf("plugin '%s': duplicate name", plug.Name)
+		}
+		seen[plug.Name] = true
+		if plug.Import == "" {
+			return fmt.Errorf("plugin '%s': missing import", plug.Name)
+		}
+		if plug.Version != "" && !validVersion.MatchString(plug.Version) {
+			return fmt.Errorf("plugin '%s': bad version '%s'", plug.Name, plug.Version)
+		}
+		if strings.Contains(plug.Name, "@") {
+			return fmt.Errorf("plugin '%s': name can't contain '@'", plug.Name)
+		}
+		switch plug.Type {
+		case DirectivePlugin, CaddyfileLoaderPlugin, ServerPlugin, DNSProviderPlugin:
+		default:
+			return fmt.Errorf("plugin '%s': unknown type '%s'", plug.Name, plug.Type)
+		}
+		for _, pattern := range append(append([]string{}, plug.Platforms...), plug.Excludes...) {
+			_, err := path.Match(pattern, "os/arch")
+			if err != nil || strings.Count(pattern, "/") != 1 {
+				return fmt.Errorf("plugin '%s': bad platform pattern '%s'", plug.Name, pattern)
+			}
+		}
+		if plug.Caddy != "" {
+			if _, err := parseRange(plug.Caddy); err != nil {
+				return fmt.Errorf("plugin '%s': %v", plug.Name, err)
+			}
+		}
+	}
+	for _, plug := range p {
+		for _, name := range plug.Requires {
+			if name == plug.Name || !seen[name] {
+				return fmt.Errorf("plugin '%s': can't require '%s'", plug.Name, name)
+			}
+		}
+		for _, name := range plug.Conflicts {
+			if name == plug.Name || !seen[name] {
+				return fmt.Errorf("plugin '%s': can't conflict with '%s'", plug.Name, name)
+			}
+		}
+	}
+	return nil
+}
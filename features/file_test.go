@@ -0,0 +1,91 @@
+package features
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer Set(Registry)
+
+	f.WriteString(`[{"type": "server", "name": "HTTP", "import": "github.com/mholt/caddy/caddyhttp", "required": true},
+		{"type": "directive", "name": "git", "import": "github.com/abiosoft/caddy-git"}]`)
+	f.Close()
+
+	err = LoadFile(f.Name())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(Current()) != 2 || !Current().Contains("git") {
+		t.Errorf("Expected registry to be loaded from file, got %v", Current())
+	}
+
+	// A bad file must not replace the current registry
+	ioutil.WriteFile(f.Name(), []byte(`[{"type": "directive", "name": "git"}]`), 0644)
+	err = LoadFile(f.Name())
+	if err == nil {
+		t.Error("Expected error loading invalid registry")
+	}
+	if len(Current()) != 2 {
+		t.Errorf("Expected registry to be unchanged after error, got %v", Current())
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for i, test := range []struct {
+		plugins   Plugins
+		shouldErr bool
+	}{
+		{Registry, false},
+		{Plugins{}, true},
+		{Plugins{{Type: DirectivePlugin, Import: "a"}}, true},
+		{Plugins{{Type: DirectivePlugin, Name: "a"}}, true},
+		{Plugins{{Type: "nope", Name: "a", Import: "a"}}, true},
+		{Plugins{{Type: DirectivePlugin, Name: "a", Import: "a"}, {Type: DirectivePlugin, Name: "a", Import: "b"}}, true},
+		{Plugins{{Type: DirectivePlugin, Name: "a", Import: "a", Version: "v1.2.0"}}, false},
+		{Plugins{{Type: DirectivePlugin, Name: "a", Import: "a", Version: "-v1; rm"}}, true},
+		{Plugins{{Type: DirectivePlugin, Name: "a@v1", Import: "a"}}, true},
+		{Plugins{{Type: DirectivePlugin, Name: "a", Import: "a", Caddy: ">=0.9, <0.10"}}, false},
+		{Plugins{{Type: DirectivePlugin, Name: "a", Import: "a", Caddy: "~>0.9"}}, true},
+	} {
+		err := test.plugins.Validate()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got %v", i, err)
+		}
+	}
+}
+
+func TestValidateRelationships(t *testing.T) {
+	for i, test := range []struct {
+		requires, conflicts []string
+		shouldErr           bool
+	}{
+		{[]string{"b"}, nil, false},
+		{nil, []string{"b"}, false},
+		{[]string{"a"}, nil, true},
+		{nil, []string{"a"}, true},
+		{[]string{"nope"}, nil, true},
+		{nil, []string{"nope"}, true},
+	} {
+		plugins := Plugins{
+			{Type: DirectivePlugin, Name: "a", Import: "a", Requires: test.requires, Conflicts: test.conflicts},
+			{Type: DirectivePlugin, Name: "b", Import: "b"},
+		}
+		err := plugins.Validate()
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got %v", i, err)
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package features
 
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
 // PluginType describes a plugin type
 type PluginType string
 
@@ -16,13 +23,41 @@ type Plugin struct {
 	Type        PluginType `json:"type"`
 	Name        string     `json:"name"`
 	Import      string     `json:"import"`                // i.e. the fully qualified package name
+	Version     string     `json:"version,omitempty"`     // version (tag) or commit to build with; empty means whatever is current
 	Description string     `json:"description,omitempty"` // does not end with a period
 	DocsURL     string     `json:"docs,omitempty"`        // path-absolute ("/docs/...") used in href attributes
 	Default     bool       `json:"default,omitempty"`     // if true, this plugin will be selected by default on the download page
 	Required    bool       `json:"required,omitempty"`    // if true, this plugin will always be included in a build
+	Requires    []string   `json:"requires,omitempty"`    // names of plugins that are added to a build along with this one
+	Conflicts   []string   `json:"conflicts,omitempty"`   // names of plugins that can't be in the same build as this one
+	Platforms   []string   `json:"platforms,omitempty"`   // "os/arch" patterns (e.g. "linux/*") this plugin builds on; empty means all
+	Excludes    []string   `json:"excludes,omitempty"`    // "os/arch" patterns this plugin does not build on, even if in Platforms
+	Caddy       string     `json:"caddy,omitempty"`       // range of Caddy versions this plugin builds with (e.g. ">=0.9, <0.10"); empty means all
+}
+
+// SupportsPlatform returns whether the plugin can be
+// built for the given operating system and architecture.
+func (p Plugin) SupportsPlatform(goOS, goArch string) bool {
+	platform := goOS + "/" + goArch
+	for _, pattern := range p.Excludes {
+		if matched, _ := path.Match(pattern, platform); matched {
+			return false
+		}
+	}
+	if len(p.Platforms) == 0 {
+		return true
+	}
+	for _, pattern := range p.Platforms {
+		if matched, _ := path.Match(pattern, platform); matched {
+			return true
+		}
+	}
+	return false
 }
 
-// Registry is the list of plugins to show on the download page.
+// Registry is the built-in list of plugins to show on the
+// download page. It is used unless a registry file is loaded
+// with LoadFile, which takes the same JSON as /features.json.
 // The order does not matter.
 var Registry = Plugins{
 	// Server types
@@ -119,6 +154,7 @@ var Registry = Plugins{
 		Import:      "github.com/hacdias/caddy-hugo",
 		Description: "Static site generator with admin interface",
 		DocsURL:     "/docs/hugo",
+		Requires:    []string{"filemanager"},
 	},
 	{
 		Type:        DirectivePlugin,
@@ -210,6 +246,135 @@ func (p Plugins) Contains(name string) bool {
 	return false
 }
 
+// Get returns the plugin in p with the given name.
+func (p Plugins) Get(name string) (Plugin, bool) {
+	for _, plug := range p {
+		if plug.Name == name {
+			return plug, true
+		}
+	}
+	return Plugin{}, false
+}
+
+// Spec returns the name of the plugin followed by
+// "@" and its version, if it has one.
+func (p Plugin) Spec() string {
+	if p.Version == "" {
+		return p.Name
+	}
+	return p.Name + "@" + p.Version
+}
+
+// ParseSpec splits a plugin spec like "name@version"
+// into its name and version; the version is optional.
+func ParseSpec(spec string) (name, version string) {
+	if i := strings.Index(spec, "@"); i > -1 {
+		return spec[:i], spec[i+1:]
+	}
+	return spec, ""
+}
+
+// validVersion matches versions that are safe to pass to
+// version control and the go command: tags, branches and
+// commit hashes, but nothing that looks like a flag.
+var validVersion = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+/-]*$`)
+
+// Resolve returns the plugins in p that make up a build with
+// the given plugin specs: the named plugins, the plugins they
+// require (recursively), and the required plugins. They are
+// returned in the order they appear in p. A spec may pin the
+// version of a plugin with "name@version", which overrides
+// the version in p. An error is returned if a name is not in
+// p, a version is malformed, or if any of the plugins
+// conflict; the error lists every conflicting pair.
+func (p Plugins) Resolve(specs []string) (Plugins, error) {
+	selected := make(map[string]bool)
+	versions := make(map[string]string)
+	var pending []string
+	for _, spec := range specs {
+		name, version := ParseSpec(spec)
+		if version != "" {
+			if !validVersion.MatchString(version) {
+				return nil, fmt.Errorf("bad version '%s' for feature '%s'", version, name)
+			}
+			if v, ok := versions[name]; ok && v != version {
+				return nil, fmt.Errorf("feature '%s' requested at versions %s and %s", name, v, version)
+			}
+			versions[name] = version
+		}
+		pending = append(pending, name)
+	}
+	for _, plug := range p {
+		if plug.Required {
+			pending = append(pending, plug.Name)
+		}
+	}
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if selected[name] {
+			continue
+		}
+		plug, ok := p.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown feature '%s'", name)
+		}
+		selected[name] = true
+		pending = append(pending, plug.Requires...)
+	}
+
+	var resolved Plugins
+	var clashes []string
+	reported := make(map[string]bool)
+	for _, plug := range p {
+		if !selected[plug.Name] {
+			continue
+		}
+		if version, ok := versions[plug.Name]; ok {
+			plug.Version = version
+		}
+		resolved = append(resolved, plug)
+		for _, other := range plug.Conflicts {
+			if selected[other] && !reported[other+","+plug.Name] {
+				reported[plug.Name+","+other] = true
+				clashes = append(clashes, "'"+plug.Name+"' and '"+other+"'")
+			}
+		}
+	}
+	if len(clashes) > 0 {
+		return nil, fmt.Errorf("conflicting features: %s", strings.Join(clashes, ", "))
+	}
+
+	return resolved, nil
+}
+
+// ForPlatform returns the plugins in p that can be built
+// for the given operating system and architecture.
+func (p Plugins) ForPlatform(goOS, goArch string) Plugins {
+	var supported Plugins
+	for _, plug := range p {
+		if plug.SupportsPlatform(goOS, goArch) {
+			supported = append(supported, plug)
+		}
+	}
+	return supported
+}
+
+// Specs returns the spec of each plugin in p.
+func (p Plugins) Specs() []string {
+	specs := make([]string, len(p))
+	for i, plug := range p {
+		specs[i] = plug.Spec()
+	}
+	return specs
+}
+
+// SpecString serializes the list of specs into a comma-separated
+// string. Unlike String, it includes the pinned versions.
+func (p Plugins) SpecString() string {
+	return strings.Join(p.Specs(), ",")
+}
+
 // String serializes the list of names into a comma-separated string.
 func (p Plugins) String() string {
 	if len(p) == 0 {
@@ -0,0 +1,105 @@
+package features
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	registry := Plugins{
+		{Name: "core", Required: true},
+		{Name: "a", Requires: []string{"b"}},
+		{Name: "b", Requires: []string{"c"}},
+		{Name: "c"},
+		{Name: "d", Conflicts: []string{"c"}},
+		{Name: "e"},
+	}
+
+	for i, test := range []struct {
+		names       []string
+		expected    string
+		expectedErr string
+	}{
+		{nil, "core", ""},
+		{[]string{"e"}, "core,e", ""},
+		{[]string{"a"}, "core,a,b,c", ""},
+		{[]string{"e", "c", "core"}, "core,c,e", ""},
+		{[]string{"d", "e"}, "core,d,e", ""},
+		{[]string{"d", "a"}, "", "'d' and 'c'"},
+		{[]string{"c", "d"}, "", "'d' and 'c'"},
+		{[]string{"nope"}, "", "unknown feature 'nope'"},
+	} {
+		resolved, err := registry.Resolve(test.names)
+		if test.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: Expected error containing '%s', got %v", i, test.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if resolved.String() != test.expected {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expected, resolved.String())
+		}
+	}
+}
+
+func TestResolveVersions(t *testing.T) {
+	registry := Plugins{
+		{Name: "a", Version: "v1.0.0"},
+		{Name: "b", Requires: []string{"a"}},
+		{Name: "c"},
+	}
+
+	for i, test := range []struct {
+		specs       []string
+		expected    string
+		expectedErr string
+	}{
+		{[]string{"a"}, "a@v1.0.0", ""},
+		{[]string{"a@v1.2.0"}, "a@v1.2.0", ""},
+		{[]string{"b", "a@v1.2.0"}, "a@v1.2.0,b", ""},
+		{[]string{"c@1a2b3c", "a@v1.2.0", "a@v1.2.0"}, "a@v1.2.0,c@1a2b3c", ""},
+		{[]string{"a@v1.2.0", "a@v1.3.0"}, "", "versions v1.2.0 and v1.3.0"},
+		{[]string{"a@-u"}, "", "bad version"},
+		{[]string{"nope@v1"}, "", "unknown feature 'nope'"},
+	} {
+		resolved, err := registry.Resolve(test.specs)
+		if test.expectedErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedErr) {
+				t.Errorf("Test %d: Expected error containing '%s', got %v", i, test.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+		if actual := resolved.SpecString(); actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestSupportsPlatform(t *testing.T) {
+	for i, test := range []struct {
+		platforms, excludes []string
+		goOS, goArch        string
+		expected            bool
+	}{
+		{nil, nil, "linux", "amd64", true},
+		{[]string{"linux/*"}, nil, "linux", "amd64", true},
+		{[]string{"linux/*"}, nil, "windows", "amd64", false},
+		{[]string{"*/amd64", "darwin/*"}, nil, "darwin", "arm", true},
+		{nil, []string{"windows/*"}, "windows", "386", false},
+		{nil, []string{"*/arm"}, "linux", "arm64", true},
+		{[]string{"linux/*"}, []string{"linux/arm"}, "linux", "arm", false},
+	} {
+		plugin := Plugin{Platforms: test.platforms, Excludes: test.excludes}
+		if actual := plugin.SupportsPlatform(test.goOS, test.goArch); actual != test.expected {
+			t.Errorf("Test %d: Expected %v for %s/%s, got %v", i, test.expected, test.goOS, test.goArch, actual)
+		}
+	}
+}
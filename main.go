@@ -1,7 +1,9 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
@@ -9,12 +11,17 @@ import (
 	"os/exec"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/buildsrv/features"
 	"github.com/caddyserver/buildsrv/server"
 )
 
+// configFile is the configuration file to read, if it exists;
+// see server.Config. Another one can be chosen with -config.
+const configFile = "buildsrv.json"
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 
@@ -22,44 +29,189 @@ func init() {
 	cmd := exec.Command("go", "env", "GOPATH")
 	result, err := cmd.Output()
 	if err != nil {
-		log.Fatal("Cannot locate GOPATH:", err)
+		fatal("locating GOPATH", "error", err)
 	}
 	server.CaddyPath = strings.TrimSpace(string(result)) + "/src/" + server.MainCaddyPackage
+}
 
-	// Log to a file
-	outfile, err := os.OpenFile("builds.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+func main() {
+	// Read the configuration: the file, overridden by
+	// environment variables, overridden by flags
+	configPath := flag.String("config", configFile, "configuration file")
+	loadConfig := server.ConfigFlags(flag.CommandLine)
+	flag.Parse()
+	configSet := false
+	flag.Visit(func(f *flag.Flag) {
+		configSet = configSet || f.Name == "config"
+	})
+	cfg, err := loadConfig(*configPath, configSet)
 	if err != nil {
-		log.Fatal("Couldn't open log file:", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	log.SetOutput(outfile)
-}
+	cfg.Apply()
 
-func main() {
-	go func() {
-		// Delete existing builds on quit
-		interrupt := make(chan os.Signal)
-		signal.Notify(interrupt, os.Interrupt, os.Kill)
-		<-interrupt
+	// Log to a file, which is rotated so it doesn't grow forever;
+	// lines from the log package become entries like any other
+	server.SetLogOutput(&server.LogFile{
+		Path:       cfg.LogFile,
+		MaxSize:    cfg.LogMaxSize,
+		MaxAge:     cfg.LogMaxAge.Duration,
+		MaxBackups: cfg.LogMaxBackups,
+	})
+	log.SetFlags(0)
+	log.SetOutput(server.StandardLogWriter())
 
-		err := os.RemoveAll(server.BuildPath)
+	// Use the registry file, if there is one, instead of the
+	// built-in registry; reload it on SIGHUP or when it changes
+	if registryFile := cfg.Registry; registryFile != "" {
+		err = features.LoadFile(registryFile)
 		if err != nil {
-			log.Fatal(err)
+			fatal("loading registry", "file", registryFile, "error", err)
+		}
+		reloaded := func(err error) {
+			if err != nil {
+				server.Log(server.LevelError, "reloading registry", "file", registryFile, "error", err)
+				return
+			}
+			server.Log(server.LevelInfo, "reloaded registry", "file", registryFile)
 		}
+		go features.Watch(registryFile, 5*time.Second, reloaded)
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				reloaded(features.LoadFile(registryFile))
+			}
+		}()
+	}
+
+	// Build with Go modules if configured to
+	if cfg.Modules != "" {
+		builder, err := server.LoadModuleBuilder(cfg.Modules)
+		if err != nil {
+			fatal("loading modules configuration", "error", err)
+		}
+		server.DefaultBuilder = builder
+	}
+
+	// Use the configured platforms instead of the built-in ones
+	if cfg.Platforms != "" {
+		err = server.LoadPlatforms(cfg.Platforms)
+		if err != nil {
+			fatal("loading platforms", "error", err)
+		}
+	}
+
+	// Let builds choose a Caddy version if there are any to choose
+	if cfg.Versions != "" {
+		err = server.LoadCaddyVersions(cfg.Versions)
+		if err != nil {
+			fatal("loading Caddy versions", "error", err)
+		}
+	}
+
+	// Sign builds if there is a key to sign them with
+	if cfg.SigningKey != "" {
+		err = server.LoadSigningKey(cfg.SigningKey)
+		if err != nil {
+			fatal("loading signing key", "error", err)
+		}
+	}
+
+	// Pick up where we left off; builds are kept across restarts
+	err = server.LoadBuilds(server.BuildPath)
+	if err != nil {
+		fatal("loading builds", "dir", server.BuildPath, "error", err)
+	}
+	go server.ManageCache(10 * time.Minute)
 
-		os.Exit(0)
-	}()
 	http.HandleFunc("/download/build", server.BuildHandler)
-	http.Handle("/download/builds/", http.StripPrefix("/download/builds/", http.FileServer(http.Dir(server.BuildPath))))
-	http.HandleFunc("/features.json", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Add("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Content-Type", "application/json")
-		var plugins features.Plugins
-		for _, plugin := range features.Registry {
-			if plugin.Name != "" {
-				plugins = append(plugins, plugin)
+	http.HandleFunc(server.APIBuildsPath, server.BuildsAPIHandler)
+	http.HandleFunc(server.APIBuildsPath+"/", server.BuildsAPIHandler)
+	http.Handle(server.BuildFilesPath, server.BuildFilesHandler(server.BuildFilesPath))
+	http.HandleFunc("/features.json", server.FeaturesHandler)
+	http.HandleFunc("/download/minisign.pub", server.SigningKeyHandler)
+	http.HandleFunc(server.MetricsPath, server.MetricsHandler)
+	srv := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: server.RequestIDHandler(http.DefaultServeMux),
+	}
+	servers := []*http.Server{srv}
+	if cfg.TLSCert != "" {
+		// Serve HTTPS (and HTTP/2) with a certificate that is
+		// reloaded when it changes or on SIGHUP
+		cert, err := server.LoadCertificate(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			fatal("loading certificate", "error", err)
+		}
+		go cert.Watch(time.Minute, nil)
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				err := cert.Reload()
+				if err != nil {
+					server.Log(server.LevelError, "reloading certificate", "error", err)
+					continue
+				}
+				server.Log(server.LevelInfo, "reloaded certificate")
 			}
+		}()
+		srv.TLSConfig = cert.TLSConfig()
+
+		if cfg.RedirectListen != "" {
+			servers = append(servers, &http.Server{
+				Addr:    cfg.RedirectListen,
+				Handler: server.RedirectHandler(cfg.Listen),
+			})
 		}
-		json.NewEncoder(w).Encode(plugins)
-	})
-	http.ListenAndServe(":5050", nil)
+	}
+	for _, s := range servers {
+		go func(s *http.Server) {
+			var err error
+			if s.TLSConfig != nil {
+				err = s.ListenAndServeTLS("", "")
+			} else {
+				err = s.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				fatal("serving", "addr", s.Addr, "error", err)
+			}
+		}(s)
+	}
+
+	// Shut down gracefully: stop taking builds, let the running
+	// builds and downloads finish, within reason, then clean up.
+	// A second signal exits right away.
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	server.Log(server.LevelInfo, "shutting down", "signal", sig, "timeout", cfg.ShutdownTimeout.Duration)
+	go func() {
+		<-stop
+		fatal("exiting without waiting")
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	buildsDone := make(chan error, 1)
+	go func() {
+		buildsDone <- server.Shutdown(ctx)
+	}()
+	for _, s := range servers {
+		err = s.Shutdown(ctx)
+		if err != nil {
+			server.Log(server.LevelWarn, "not all requests finished", "addr", s.Addr, "error", err)
+		}
+	}
+	<-buildsDone
+	server.Cleanup()
+	server.Log(server.LevelInfo, "shut down")
+}
+
+// fatal logs an error entry and exits.
+func fatal(msg string, kv ...interface{}) {
+	server.Log(server.LevelError, msg, kv...)
+	os.Exit(1)
 }
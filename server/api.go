@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIBuildsPath is the path at which BuildsAPIHandler is expected
+// to be mounted, both with and without a trailing slash.
+const APIBuildsPath = "/api/builds"
+
+// BuildsAPIHandler is the endpoint for asynchronous build jobs.
+// POST to APIBuildsPath to start a job (or join an identical one);
+// the response contains the job ID immediately. GET
+// APIBuildsPath/{id} to poll the job's status, including its
+// position in the queue while it waits for a worker. Once it has
+// succeeded, the status includes the URL to download the build from.
+// GET APIBuildsPath/{id}/log to follow the job's output as a stream
+// of server-sent events.
+func BuildsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r)
+	w.Header().Add("Access-Control-Expose-Headers", "Location, "+QueuePositionHeader)
+	if preflight(w, r, "GET, POST, OPTIONS") {
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, APIBuildsPath), "/")
+	if path == "" {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			handleError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		createJob(w, r)
+		return
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		handleError(w, r, errors.New("method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, resource := path, ""
+	if i := strings.Index(path, "/"); i > -1 {
+		id, resource = path[:i], path[i+1:]
+	}
+
+	buildsMutex.Lock()
+	b, ok := jobs[id]
+	buildsMutex.Unlock()
+	if !ok {
+		handleError(w, r, errors.New("no such build job"), http.StatusNotFound)
+		return
+	}
+
+	switch resource {
+	case "":
+		writeJobStatus(w, b, http.StatusOK)
+	case "log":
+		streamLog(w, r, b)
+	default:
+		handleError(w, r, errors.New("not found"), http.StatusNotFound)
+	}
+}
+
+// createJob reserves a build job for the request in r and starts
+// it in the background unless an identical job already exists.
+func createJob(w http.ResponseWriter, r *http.Request) {
+	var req buildRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		handleError(w, r, errors.New("malformed request body: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	orderedFeatures, err := checkInput(req.OS, req.Arch, req.ARM, req.Features)
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	err = checkCaddyVersion(req.Version, orderedFeatures)
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+	err = checkBuilder(Target{GoOS: req.OS, GoArch: req.Arch, GoARM: req.ARM, CaddyVersion: req.Version, Plugins: orderedFeatures})
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	b, created := reserveBuild(req.OS, req.Arch, req.ARM, req.Version, orderedFeatures)
+	if created {
+		b.RequestID = requestID(r)
+		err = queue.enqueue(b)
+		if err != nil {
+			b.cancel(err)
+			w.Header().Set("Retry-After", queueRetryAfter)
+			handleError(w, r, err, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Header().Set("Location", APIBuildsPath+"/"+b.ID)
+
+	status := http.StatusAccepted
+	if b.State() == JobSucceeded {
+		status = http.StatusOK
+	}
+	writeJobStatus(w, b, status)
+}
+
+// streamLog streams the output of b to the client as server-sent
+// events, one event per line, until the build job is done. The
+// event IDs are offsets into the log, so a client that reconnects
+// with a Last-Event-ID header picks up where it left off. The
+// final event is an "end" event with the state of the job.
+func streamLog(w http.ResponseWriter, r *http.Request, b *Build) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		handleError(w, r, errors.New("streaming not supported"), http.StatusInternalServerError)
+		return
+	}
+
+	offset, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		data, closed, update := b.output.read(offset)
+		for len(data) > 0 {
+			line := data
+			if i := bytes.IndexByte(data, '\n'); i > -1 {
+				line = data[:i+1]
+			}
+			data = data[len(line):]
+			offset += len(line)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, bytes.TrimRight(line, "\r\n"))
+		}
+		if closed {
+			fmt.Fprintf(w, "event: end\ndata: %s\n\n", b.State())
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-update:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeJobStatus writes the status of b to w as JSON.
+func writeJobStatus(w http.ResponseWriter, b *Build, status int) {
+	js := b.status()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if js.Position > 0 {
+		w.Header().Set(QueuePositionHeader, strconv.Itoa(js.Position))
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(js)
+}
+
+// buildRequest is the body of a request to create a build job.
+type buildRequest struct {
+	OS       string   `json:"os"`
+	Arch     string   `json:"arch"`
+	ARM      string   `json:"arm,omitempty"`
+	Version  string   `json:"version,omitempty"`
+	Features []string `json:"features"`
+}
+
+// jobStatus describes the progress of a build job to API clients.
+type jobStatus struct {
+	ID           string     `json:"id"`
+	State        JobState   `json:"status"`
+	OS           string     `json:"os"`
+	Arch         string     `json:"arch"`
+	ARM          string     `json:"arm,omitempty"`
+	Version      string     `json:"version,omitempty"`
+	Features     []string   `json:"features"`
+	Created      time.Time  `json:"created"`
+	Started      *time.Time `json:"started,omitempty"`
+	Finished     *time.Time `json:"finished,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Position     int        `json:"queue_position,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	LogURL       string     `json:"log_url"`
+	DownloadURL  string     `json:"download_url,omitempty"`
+	Checksum     string     `json:"sha256,omitempty"`
+	ChecksumURL  string     `json:"sha256_url,omitempty"`
+	SignatureURL string     `json:"signature_url,omitempty"`
+}
+
+// status returns a snapshot of the job's progress.
+func (b *Build) status() jobStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	js := jobStatus{
+		ID:       b.ID,
+		State:    b.state,
+		OS:       b.GoOS,
+		Arch:     b.GoArch,
+		ARM:      b.GoARM,
+		Version:  b.CaddyVersion,
+		Features: b.Features.Specs(),
+		Created:  b.Created,
+		LogURL:   APIBuildsPath + "/" + b.ID + "/log",
+	}
+	if !b.started.IsZero() {
+		started := b.started
+		js.Started = &started
+	}
+	if !b.ended.IsZero() {
+		ended := b.ended
+		js.Finished = &ended
+	}
+
+	switch b.state {
+	case JobQueued:
+		js.Position = queue.position(b)
+	case JobSucceeded:
+		js.DownloadURL = buildFileURL(b.DownloadFile)
+		js.Checksum = b.Checksum
+		js.ChecksumURL = js.DownloadURL + ".sha256"
+		if b.SignatureFile != "" {
+			js.SignatureURL = buildFileURL(b.SignatureFile)
+		}
+		if !b.Expires.IsZero() {
+			expires := b.Expires
+			js.Expires = &expires
+		}
+	case JobFailed:
+		// The details are in the build log, unless
+		// the job never ran and can be tried again
+		js.Error = "build failed"
+		if notQueued(b.err) {
+			js.Error = b.err.Error()
+		}
+	}
+
+	return js
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildsAPIHandlerErrors(t *testing.T) {
+	for i, test := range []struct {
+		method, path, body string
+		expectedStatus     int
+	}{
+		{"GET", "/api/builds", "", http.StatusMethodNotAllowed},
+		{"POST", "/api/builds", "not json", http.StatusBadRequest},
+		{"POST", "/api/builds", `{"arch": "amd64"}`, http.StatusBadRequest},
+		{"POST", "/api/builds", `{"os": "linux", "arch": "amd64", "features": ["nope"]}`, http.StatusBadRequest},
+		{"GET", "/api/builds/nonexistent", "", http.StatusNotFound},
+		{"DELETE", "/api/builds/nonexistent", "", http.StatusMethodNotAllowed},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		rec := httptest.NewRecorder()
+		BuildsAPIHandler(rec, req)
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, rec.Code)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	defer useFakeBuilds(t)()
+	oldOrigins := CORSOrigins
+	CORSOrigins = []string{"https://caddyserver.com"}
+	defer func() { CORSOrigins = oldOrigins }()
+
+	for i, test := range []struct {
+		handler        http.HandlerFunc
+		path           string
+		requestMethod  string
+		expectedMethod string
+	}{
+		{BuildsAPIHandler, "/api/builds", "POST", "POST"},
+		{BuildsAPIHandler, "/api/builds/abc123", "GET", "GET"},
+		{BuildHandler, "/download/build?os=linux&arch=amd64", "GET", "GET"},
+	} {
+		req := httptest.NewRequest("OPTIONS", test.path, nil)
+		req.Header.Set("Origin", "https://caddyserver.com")
+		req.Header.Set("Access-Control-Request-Method", test.requestMethod)
+		req.Header.Set("Access-Control-Request-Headers", "content-type, prefer")
+		rec := httptest.NewRecorder()
+		test.handler(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("Test %d: Expected status %d, got %d", i, http.StatusNoContent, rec.Code)
+		}
+		if origin := rec.Header().Get("Access-Control-Allow-Origin"); origin != "https://caddyserver.com" {
+			t.Errorf("Test %d: Expected allowed origin, got '%s'", i, origin)
+		}
+		if methods := rec.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, test.expectedMethod) {
+			t.Errorf("Test %d: Expected %s in allowed methods, got '%s'", i, test.expectedMethod, methods)
+		}
+		headers := rec.Header().Get("Access-Control-Allow-Headers")
+		if !strings.Contains(headers, "Content-Type") || !strings.Contains(headers, "Prefer") {
+			t.Errorf("Test %d: Expected Content-Type and Prefer in allowed headers, got '%s'", i, headers)
+		}
+	}
+
+	// preflight requests don't start builds
+	buildsMutex.Lock()
+	n := len(builds)
+	buildsMutex.Unlock()
+	if n != 0 {
+		t.Errorf("Expected no builds, got %d", n)
+	}
+}
+
+func TestBuildsAPIHandlerStatus(t *testing.T) {
+	b := &Build{
+		ID:           "abc123",
+		DoneChan:     make(chan struct{}),
+		DownloadFile: "builds/1/caddy_linux_amd64_custom.tar.gz",
+		GoOS:         "linux",
+		GoArch:       "amd64",
+		Hash:         "linux:amd64::",
+		Created:      time.Now(),
+		state:        JobQueued,
+	}
+	buildsMutex.Lock()
+	jobs[b.ID] = b
+	buildsMutex.Unlock()
+	defer func() {
+		buildsMutex.Lock()
+		delete(jobs, b.ID)
+		buildsMutex.Unlock()
+	}()
+
+	getStatus := func() jobStatus {
+		req := httptest.NewRequest("GET", "/api/builds/abc123", nil)
+		rec := httptest.NewRecorder()
+		BuildsAPIHandler(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+		var js jobStatus
+		if err := json.NewDecoder(rec.Body).Decode(&js); err != nil {
+			t.Fatalf("Expected valid JSON, but got error: %v", err)
+		}
+		return js
+	}
+
+	js := getStatus()
+	if js.State != JobQueued {
+		t.Errorf("Expected state %s, got %s", JobQueued, js.State)
+	}
+	if js.DownloadURL != "" {
+		t.Errorf("Expected no download URL before the build is done, got '%s'", js.DownloadURL)
+	}
+
+	b.finish()
+	defer deleteBuildJob(b.Hash)
+
+	js = getStatus()
+	if js.State != JobSucceeded {
+		t.Errorf("Expected state %s, got %s", JobSucceeded, js.State)
+	}
+	if js.Finished == nil {
+		t.Error("Expected finished timestamp, but there wasn't one")
+	}
+	if expected := "/download/builds/1/caddy_linux_amd64_custom.tar.gz"; js.DownloadURL != expected {
+		t.Errorf("Expected download URL '%s', got '%s'", expected, js.DownloadURL)
+	}
+}
+
+func TestBuildsAPIHandlerLog(t *testing.T) {
+	b := &Build{
+		ID:       "log123",
+		DoneChan: make(chan struct{}),
+		state:    JobFailed,
+		output:   newBuildLog(),
+	}
+	b.output.Write([]byte("compiling\nerror: oops\n"))
+	b.output.Close()
+
+	buildsMutex.Lock()
+	jobs[b.ID] = b
+	buildsMutex.Unlock()
+	defer func() {
+		buildsMutex.Lock()
+		delete(jobs, b.ID)
+		buildsMutex.Unlock()
+	}()
+
+	req := httptest.NewRequest("GET", "/api/builds/log123/log", nil)
+	req.Header.Set("Last-Event-ID", "10") // skip first line
+	rec := httptest.NewRecorder()
+	BuildsAPIHandler(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected event stream content type, got '%s'", ct)
+	}
+	expected := "id: 22\ndata: error: oops\n\nevent: end\ndata: failed\n\n"
+	if body := rec.Body.String(); body != expected {
+		t.Errorf("Expected body:\n%q\nbut got:\n%q", expected, body)
+	}
+}
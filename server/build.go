@@ -1,32 +1,166 @@
 package server
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/caddyserver/buildsrv/features"
-	"github.com/caddyserver/caddydev/caddybuild"
-	"github.com/mholt/archiver"
+)
+
+// JobState describes where a build job is in its lifecycle.
+type JobState string
+
+// The states a build job can be in.
+const (
+	JobQueued    JobState = "queued"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
 )
 
 // Build represents a custom build job.
 type Build struct {
+	ID                      string
 	DoneChan                chan struct{}
-	OutputFile              string
+	OutputFile              string // the binary, which is kept to make other artifacts from
 	DownloadFilename        string
 	DownloadFileCompression int
 	DownloadFile            string
+	LogFile                 string
+	SignatureFile           string // empty if builds aren't signed
+	Checksum                string // hex-encoded SHA-256 of DownloadFile
 	GoOS                    string
 	GoArch                  string
 	GoARM                   string
+	CaddyVersion            string // empty for the Builder's own version
 	Features                features.Plugins
 	Hash                    string
+	RequestID               string // of the request that started the job
 	Expires                 time.Time
+	Created                 time.Time
 	finished                bool
+	platform                Platform   // how to build for GoOS/GoArch
+	output                  *buildLog  // output of the build job, as it happens
+	packMu                  sync.Mutex // serializes packaging of artifacts
+
+	mu         sync.Mutex // protects the fields below
+	state      JobState
+	started    time.Time
+	ended      time.Time
+	err        error
+	size       int64            // size of all the build's files in bytes
+	lastAccess time.Time        // when the build was last downloaded
+	artifacts  map[int]artifact // by compression, besides DownloadFile
+	sources    string           // what it was built from; see builderSources
+}
+
+// run performs the build job and records its progress. When it
+// returns, DoneChan is closed regardless of the outcome. A failed
+// build is removed from the builds map so it can be retried, but
+// its job ID stays around for FailedJobExpiry so clients polling
+// for the result can find out what happened.
+func (b *Build) run() error {
+	b.mu.Lock()
+	b.state = JobRunning
+	b.started = time.Now()
+	b.mu.Unlock()
+
+	logInfo("build started", b.logFields()...)
+	err := b.Build()
+	if err != nil {
+		b.output.Printf("Build failed: %v", err)
+		b.fail(err)
+	}
+	b.output.Close()
+	return err
+}
+
+// fail marks b as failed and notifies anyone waiting on it.
+func (b *Build) fail(err error) {
+	b.mu.Lock()
+	b.state = JobFailed
+	b.ended = time.Now()
+	b.err = err
+	b.mu.Unlock()
+
+	buildsMutex.Lock()
+	if builds[b.Hash] == b {
+		delete(builds, b.Hash)
+	}
+	buildsMutex.Unlock()
+
+	b.record(err)
+	close(b.DoneChan)
+
+	time.AfterFunc(FailedJobExpiry, func() {
+		buildsMutex.Lock()
+		delete(jobs, b.ID)
+		buildsMutex.Unlock()
+	})
+}
+
+// cancel fails b, which never ran, with err and ends its
+// output, so clients waiting on it or following its log
+// find out why.
+func (b *Build) cancel(err error) {
+	b.output.Printf("Build canceled: %v", err)
+	b.fail(err)
+	b.output.Close()
+}
+
+// record logs and counts the outcome of the build
+// job, which failed if err is not nil. Jobs that failed
+// before they started, like those still queued when the
+// server shuts down, have no duration.
+func (b *Build) record(err error) {
+	b.mu.Lock()
+	started := !b.started.IsZero()
+	duration := b.ended.Sub(b.started)
+	b.mu.Unlock()
+
+	recordBuild(b, started, duration, err)
+	fields := b.logFields()
+	if started {
+		fields = append(fields, "duration", duration)
+	}
+	if err != nil {
+		logError("build failed", append(fields, "error", err)...)
+	} else {
+		logInfo("build succeeded", fields...)
+	}
+}
+
+// target returns what the Builder makes for b.
+func (b *Build) target() Target {
+	return Target{
+		GoOS:         b.GoOS,
+		GoArch:       b.GoArch,
+		GoARM:        b.GoARM,
+		CGO:          b.platform.CGO,
+		Static:       b.platform.Static,
+		CaddyVersion: b.CaddyVersion,
+		Plugins:      b.Features,
+	}
+}
+
+// State returns the current state of the build job.
+func (b *Build) State() JobState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Err returns the error the build job failed with, if any.
+func (b *Build) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
 }
 
 // Build performs a build job. This function is blocking. If the build
@@ -34,56 +168,65 @@ type Build struct {
 // If it fails, resources are not automatically cleaned up.
 func (b *Build) Build() error {
 	// Prepare the build
-	builder, err := caddybuild.PrepareBuild(b.Features, false) // TODO: PullLatest (go get -u) DISABLED for stability; updates are manual for now
-	defer builder.Teardown()                                   // always perform cleanup
+	if b.CaddyVersion != "" {
+		b.output.Printf("Using Caddy %s", b.CaddyVersion)
+	}
+	if goARM := b.target().goARM(); goARM != "" {
+		b.output.Printf("Preparing build for %s/%s (ARMv%s) with features: %s", b.GoOS, b.GoArch, goARM, b.Features)
+	} else {
+		b.output.Printf("Preparing build for %s/%s with features: %s", b.GoOS, b.GoArch, b.Features)
+	}
+	err := os.MkdirAll(filepath.Dir(b.OutputFile), 0755)
 	if err != nil {
 		return err
 	}
-	builder.CommandName = "./build.bash"
-	origRepoPath := filepath.Join(os.Getenv("GOPATH"), "src/github.com/mholt/caddy")
 
 	// Perform the build
-	if b.GoArch == "arm" {
-		var armInt int
-		if b.GoARM != "" {
-			armInt, err = strconv.Atoi(b.GoARM)
-			if err != nil {
-				return err
-			}
-		} else {
-			armInt = defaultARM
-		}
-		err = builder.BuildStaticARM(b.GoOS, armInt, b.OutputFile, origRepoPath)
-	} else if b.GoOS == "darwin" { // At time of writing, building with CGO_ENABLED=0 for darwin can break stuff: https://www.reddit.com/r/golang/comments/46bd5h/ama_we_are_the_go_contributors_ask_us_anything/d03rmc9
-		err = builder.Build(b.GoOS, b.GoArch, b.OutputFile, origRepoPath)
-	} else {
-		err = builder.BuildStatic(b.GoOS, b.GoArch, b.OutputFile, origRepoPath)
+	b.output.Printf("Compiling %s", b.OutputFile)
+	target := b.target()
+	sources := builderSources(target)
+	b.mu.Lock()
+	b.sources = sources
+	b.mu.Unlock()
+	err = DefaultBuilder.Build(target, b.OutputFile, b.output)
+	if err != nil {
+		return err
 	}
+
+	// Describe the build so it can be identified later
+	buildInfoFile := filepath.Join(filepath.Dir(b.OutputFile), buildInfoFilename)
+	err = b.writeBuildInfo(buildInfoFile)
 	if err != nil {
 		return err
 	}
 
-	// File list to include with build, then compress the build
-	fileList := []string{
-		filepath.Join(CaddyPath, "/dist/README.txt"),
-		filepath.Join(CaddyPath, "/dist/LICENSES.txt"),
-		filepath.Join(CaddyPath, "/dist/CHANGES.txt"),
-		filepath.Join(CaddyPath, "/dist/init"),
-		b.OutputFile,
+	// Compress the build with the files to include with it; the
+	// binary and build info are kept to make other formats from
+	if b.DownloadFileCompression != CompressNone {
+		err = b.packInto(b.DownloadFileCompression, b.DownloadFile, b.output)
+		if err != nil {
+			return err
+		}
 	}
-	if b.DownloadFileCompression == CompressZip {
-		err = archiver.Zip(b.DownloadFile, fileList)
-	} else if b.DownloadFileCompression == CompressTarGz {
-		err = archiver.TarGz(b.DownloadFile, fileList)
-	} else {
-		return fmt.Errorf("unknown compress type %v", b.DownloadFileCompression)
+
+	// Let clients verify what they download
+	b.output.Printf("Computing checksum")
+	b.Checksum, err = checksumFile(b.DownloadFile)
+	if err != nil {
+		return err
 	}
+	b.SignatureFile, err = signFile(b.DownloadFile)
 	if err != nil {
-		return fmt.Errorf("error compressing: %v", err)
+		return fmt.Errorf("error signing: %v", err)
 	}
 
-	// Delete uncompressed binary
-	err = os.Remove(b.OutputFile)
+	// Keep the log and the manifest next to the build
+	b.output.Printf("Build succeeded")
+	err = b.output.save(b.LogFile)
+	if err != nil {
+		return err
+	}
+	err = b.saveManifest()
 	if err != nil {
 		return err
 	}
@@ -99,44 +242,74 @@ func (b *Build) Build() error {
 // done with its build process and the result is ready
 // for use. When this method is called, its lifetime
 // begins and the build will be deleted after the
-// expiration time.
+// expiration time, or sooner if the cache is over quota.
 func (b *Build) finish() {
 	if b.finished {
 		return
 	}
 
-	// Notify anyone waiting for the job to finish that it's done
-	close(b.DoneChan)
+	b.updateSize()
 
 	// Save the build in the master list
 	buildsMutex.Lock()
 	builds[b.Hash] = b
 	buildsMutex.Unlock()
 
-	// Make this idempotent
-	b.finished = true
+	// Make room for this build if necessary
+	evictBuilds(b)
 
+	b.mu.Lock()
+	b.state = JobSucceeded
+	b.ended = time.Now()
+	b.lastAccess = b.ended
 	if BuildExpiry > 0 {
 		// Build lifetime starts now
-		b.Expires = time.Now().Add(BuildExpiry)
+		b.Expires = b.ended.Add(BuildExpiry)
+	}
+	b.mu.Unlock()
+
+	// Make this idempotent
+	b.finished = true
+	b.record(nil)
 
-		// Delete build after expiration time
-		go func() {
-			time.Sleep(BuildExpiry)
+	// Notify anyone waiting for the job to finish that it's done
+	close(b.DoneChan)
+}
 
-			// Delete the job
-			deleteBuildJob(b.Hash)
+// updateSize records the total size of the files of b.
+func (b *Build) updateSize() {
+	var size int64
+	filepath.Walk(filepath.Dir(b.DownloadFile), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	b.mu.Lock()
+	b.size = size
+	b.mu.Unlock()
+}
 
-			// Delete file and its folder
-			err := os.RemoveAll(filepath.Dir(b.DownloadFile))
-			if err != nil {
-				log.Println(err)
-			}
-		}()
+// buildFeatures returns the features part of a build hash, which
+// identifies the code that goes into a build: the specs of the
+// plugins, preceded by the Caddy version if one was chosen.
+func buildFeatures(caddyVersion string, plugins features.Plugins) string {
+	if caddyVersion == "" {
+		return plugins.SpecString()
 	}
+	return strings.Join(append([]string{"caddy@" + caddyVersion}, plugins.Specs()...), ",")
 }
 
 // buildHash creates a string that uniquely identifies a kind of build
 func buildHash(goOS, goArch, goARM, orderedFeatures string) string {
 	return fmt.Sprintf("%s:%s:%s:%s", goOS, goArch, goARM, orderedFeatures)
 }
+
+// newJobID returns a random, hard to guess identifier for a build job.
+func newJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/buildsrv/features"
+	"github.com/caddyserver/caddydev/caddybuild"
+)
+
+// DefaultBuilder is the Builder that build jobs compile with.
+// It must be set before the first build is queued.
+var DefaultBuilder Builder = GOPATHBuilder{}
+
+// Builder compiles Caddy binaries.
+type Builder interface {
+	// Build compiles Caddy for target and writes the binary
+	// to outputFile. Progress and compiler output may be
+	// written to log.
+	Build(target Target, outputFile string, log io.Writer) error
+}
+
+// sourcer is implemented by Builders that can tell what
+// they would build a target from, so builds made from
+// sources that have since been updated aren't served.
+type sourcer interface {
+	// sources returns an identifier of the sources of
+	// target, which changes whenever they do.
+	sources(target Target) string
+}
+
+// builderSources returns the identifier of the sources that
+// DefaultBuilder would build target from, or "" if it can't
+// tell.
+func builderSources(target Target) string {
+	s, ok := DefaultBuilder.(sourcer)
+	if !ok {
+		return ""
+	}
+	return s.sources(target)
+}
+
+// checker is implemented by Builders that can tell whether
+// they can build a target without building it, so requests
+// for builds they can't make are rejected before they are
+// queued.
+type checker interface {
+	// check returns an error if target can't be built.
+	check(target Target) error
+}
+
+// checkBuilder returns an error if DefaultBuilder can
+// tell that it can't build target.
+func checkBuilder(target Target) error {
+	c, ok := DefaultBuilder.(checker)
+	if !ok {
+		return nil
+	}
+	return c.check(target)
+}
+
+// sourcesDigest returns a short identifier of lines.
+func sourcesDigest(lines []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Target describes a binary for a Builder to make.
+type Target struct {
+	GoOS         string
+	GoArch       string
+	GoARM        string // only used if GoArch is "arm"
+	CGO          bool   // whether to build with cgo
+	Static       bool   // whether to link statically
+	CaddyVersion string // tag of Caddy to build; empty for the Builder's own
+	Plugins      features.Plugins
+}
+
+// goARM returns the GOARM that t is built with: GoARM,
+// or defaultARM if it's empty, for arm; "" otherwise.
+func (t Target) goARM() string {
+	if t.GoArch != "arm" {
+		return ""
+	}
+	if t.GoARM == "" {
+		return strconv.Itoa(defaultARM)
+	}
+	return t.GoARM
+}
+
+// GOPATHBuilder builds with caddybuild against the
+// Caddy and plugin packages checked out in GOPATH.
+// Because the checkouts are shared by all builds, it
+// can only build the versions that are checked out.
+type GOPATHBuilder struct{}
+
+// Build implements Builder.
+func (g GOPATHBuilder) Build(target Target, outputFile string, log io.Writer) error {
+	err := g.check(target)
+	if err != nil {
+		return err
+	}
+
+	builder, err := caddybuild.PrepareBuild(target.Plugins, false) // TODO: PullLatest (go get -u) DISABLED for stability; updates are manual for now
+	defer builder.Teardown()                                       // always perform cleanup
+	if err != nil {
+		return err
+	}
+
+	// run the build script ourselves, rather than with builder,
+	// so the compiler output goes to the build log
+	origRepoPath := filepath.Join(os.Getenv("GOPATH"), "src/github.com/mholt/caddy")
+	return runBuildScript(origRepoPath, target, outputFile, log)
+}
+
+// check implements checker with the checkouts of Caddy
+// and the plugins of target, which must be of the versions
+// chosen for target, if any.
+func (GOPATHBuilder) check(target Target) error {
+	err := checkCheckout(CaddyPath, target.CaddyVersion)
+	if err != nil {
+		return fmt.Errorf("caddy: %v", err)
+	}
+	srcPath := strings.TrimSuffix(CaddyPath, MainCaddyPackage)
+	for _, plugin := range target.Plugins {
+		err = checkCheckout(filepath.Join(srcPath, plugin.Import), plugin.Version)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %v", plugin.Name, err)
+		}
+	}
+	return nil
+}
+
+// sources implements sourcer with the revisions
+// checked out for Caddy and the plugins of target.
+func (GOPATHBuilder) sources(target Target) string {
+	srcPath := strings.TrimSuffix(CaddyPath, MainCaddyPackage)
+	lines := []string{MainCaddyPackage + " " + vcsRevision(CaddyPath, "HEAD")}
+	for _, plugin := range target.Plugins {
+		lines = append(lines, plugin.Import+" "+vcsRevision(filepath.Join(srcPath, plugin.Import), "HEAD"))
+	}
+	return sourcesDigest(lines)
+}
+
+// BuildScript is the script in the Caddy repository that
+// GOPATHBuilder compiles with. It's run in the repository
+// with the output file as its argument, and GOOS, GOARCH,
+// GOARM and CGO_ENABLED set for the target.
+var BuildScript = "./build.bash"
+
+// runBuildScript runs BuildScript in repo to build target
+// into outputFile, writing its output to log.
+func runBuildScript(repo string, target Target, outputFile string, log io.Writer) error {
+	outputFile, err := filepath.Abs(outputFile)
+	if err != nil {
+		return err
+	}
+	env := append(os.Environ(), "GOOS="+target.GoOS, "GOARCH="+target.GoArch)
+	if goARM := target.goARM(); goARM != "" {
+		if _, err := strconv.Atoi(goARM); err != nil {
+			return err
+		}
+		env = append(env, "GOARM="+goARM)
+	}
+	switch {
+	case target.CGO:
+		// the go command disables cgo when cross-compiling
+		env = append(env, "CGO_ENABLED=1")
+	case target.Static, target.GoArch == "arm":
+		env = append(env, "CGO_ENABLED=0")
+	}
+
+	cmd := exec.Command(BuildScript, outputFile)
+	cmd.Dir = repo
+	cmd.Env = env
+	cmd.Stdout = log
+	cmd.Stderr = log
+
+	fmt.Fprintf(log, "%s %s for %s/%s\n", BuildScript, outputFile, target.GoOS, target.GoArch)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %v", BuildScript, err)
+	}
+	return nil
+}
+
+// checkCheckout makes sure that version, if not empty, is
+// what is checked out in the git repository at dir. It doesn't
+// check anything out itself; that is left to the operator. The
+// errors don't name dir, since they are shown to clients.
+func checkCheckout(dir, version string) error {
+	if version == "" {
+		return nil
+	}
+	want := vcsRevision(dir, version+"^{commit}")
+	if want == "" {
+		return fmt.Errorf("version %s not found", version)
+	}
+	if have := vcsRevision(dir, "HEAD"); have != want {
+		return fmt.Errorf("version %s is not checked out", version)
+	}
+	return nil
+}
+
+// FakeBuilder doesn't compile anything; it writes a small
+// dummy binary that only depends on the target. It's useful
+// for testing the build server without a Go workspace.
+type FakeBuilder struct{}
+
+// Build implements Builder.
+func (FakeBuilder) Build(target Target, outputFile string, log io.Writer) error {
+	fmt.Fprintf(log, "fake build for %s/%s\n", target.GoOS, target.GoArch)
+	contents := fmt.Sprintf("fake caddy %s\nos=%s\narch=%s\narm=%s\nplugins=%s\n",
+		target.CaddyVersion, target.GoOS, target.GoArch, target.GoARM, target.Plugins.Specs())
+	return ioutil.WriteFile(outputFile, []byte(contents), 0755)
+}
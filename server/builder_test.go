@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeBuildScript is a BuildScript that prints what a
+// compiler would and writes its environment to the output
+// file, or fails like a compiler if the target is plan9.
+const fakeBuildScript = `#!/bin/sh
+echo "# github.com/mholt/caddy/caddy"
+if [ "$GOOS" = plan9 ]; then
+	echo "caddy/main.go:12: undefined: nope" >&2
+	exit 2
+fi
+echo "GOOS=$GOOS GOARCH=$GOARCH GOARM=$GOARM CGO_ENABLED=$CGO_ENABLED" > "$1"
+`
+
+// useFakeBuildScript writes fakeBuildScript to a
+// temporary repository, whose path it returns, and
+// returns a function that restores BuildScript.
+func useFakeBuildScript(t *testing.T) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("build script needs sh")
+	}
+	repo, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(repo, "build.sh"), []byte(fakeBuildScript), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldScript := BuildScript
+	BuildScript = "./build.sh"
+	return repo, func() {
+		BuildScript = oldScript
+		os.RemoveAll(repo)
+	}
+}
+
+func TestRunBuildScript(t *testing.T) {
+	repo, restore := useFakeBuildScript(t)
+	defer restore()
+
+	for i, test := range []struct {
+		target      Target
+		shouldErr   bool
+		expectEnv   string
+		expectInLog string
+	}{
+		{Target{GoOS: "linux", GoArch: "amd64"}, false, "GOOS=linux GOARCH=amd64 GOARM= CGO_ENABLED=", "# github.com/mholt/caddy/caddy"},
+		{Target{GoOS: "linux", GoArch: "amd64", Static: true}, false, "GOOS=linux GOARCH=amd64 GOARM= CGO_ENABLED=0", ""},
+		{Target{GoOS: "linux", GoArch: "arm", GoARM: "6"}, false, "GOOS=linux GOARCH=arm GOARM=6 CGO_ENABLED=0", ""},
+		{Target{GoOS: "linux", GoArch: "arm"}, false, "GOOS=linux GOARCH=arm GOARM=7 CGO_ENABLED=0", ""},
+		{Target{GoOS: "darwin", GoArch: "amd64", CGO: true}, false, "GOOS=darwin GOARCH=amd64 GOARM= CGO_ENABLED=1", ""},
+		{Target{GoOS: "linux", GoArch: "arm", GoARM: "x"}, true, "", ""},
+		{Target{GoOS: "plan9", GoArch: "amd64"}, true, "", "caddy/main.go:12: undefined: nope"},
+	} {
+		var log bytes.Buffer
+		outputFile := filepath.Join(repo, "caddy")
+		os.Remove(outputFile)
+		err := runBuildScript(repo, test.target, outputFile, &log)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected an error, but didn't get one", i)
+		} else if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got %v; log:\n%s", i, err, log.String())
+		}
+		if !strings.Contains(log.String(), test.expectInLog) {
+			t.Errorf("Test %d: Expected '%s' in log, got:\n%s", i, test.expectInLog, log.String())
+		}
+		if test.expectEnv == "" {
+			continue
+		}
+		env, err := ioutil.ReadFile(outputFile)
+		if err != nil {
+			t.Errorf("Test %d: Expected output file, but: %v", i, err)
+		} else if strings.TrimSpace(string(env)) != test.expectEnv {
+			t.Errorf("Test %d: Expected build environment '%s', got '%s'", i, test.expectEnv, strings.TrimSpace(string(env)))
+		}
+	}
+}
+
+// scriptBuilder builds with the build script in its repo.
+type scriptBuilder struct {
+	repo string
+}
+
+func (sb scriptBuilder) Build(target Target, outputFile string, log io.Writer) error {
+	return runBuildScript(sb.repo, target, outputFile, log)
+}
+
+func TestBuildLogHasCompilerOutput(t *testing.T) {
+	defer useFakeBuilds(t)()
+	repo, restore := useFakeBuildScript(t)
+	defer restore()
+	DefaultBuilder = scriptBuilder{repo}
+
+	b, _ := reserveBuild("linux", "amd64", "", "", nil)
+	defer deleteBuildJob(b.Hash)
+	err := b.Build()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	log, err := ioutil.ReadFile(b.LogFile)
+	if err != nil {
+		t.Fatalf("Expected build log to be saved, but: %v", err)
+	}
+	if !strings.Contains(string(log), "# github.com/mholt/caddy/caddy") {
+		t.Errorf("Expected compiler output in build log, got:\n%s", log)
+	}
+}
@@ -2,7 +2,6 @@ package server
 
 import (
 	"errors"
-	"io"
 	"math/rand"
 	"net/http"
 	"os"
@@ -15,206 +14,297 @@ import (
 )
 
 // BuildHandler is the endpoint which creates and/or responds with builds.
+// It waits for the build to finish, unless the request has a "Prefer:
+// respond-async" header; then, if the build isn't done yet, the response
+// is 202 Accepted with the job's status, its URL in Location and its
+// place in the queue, if it's waiting for a worker, in QueuePositionHeader.
 func BuildHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.Header().Add("Access-Control-Expose-Headers", "Location")
+	setCORS(w, r)
+	w.Header().Add("Access-Control-Expose-Headers", "Location, Digest, ETag, "+QueuePositionHeader+", "+RequestIDHeader)
+	if preflight(w, r, "GET, HEAD, OPTIONS") {
+		return
+	}
 
 	goOS := r.URL.Query().Get("os")
 	goArch := r.URL.Query().Get("arch")
 	goARM := r.URL.Query().Get("arm")
+	caddyVersion := r.URL.Query().Get("version")
+	format := r.URL.Query().Get("format")
 	featureList := strings.Split(r.URL.Query().Get("features"), ",")
 	if len(featureList) == 1 && featureList[0] == "" {
 		featureList = []string{}
 	}
 
-	err := checkInput(goOS, goArch, goARM, featureList)
+	orderedFeatures, err := checkInput(goOS, goArch, goARM, featureList)
 	if err != nil {
 		handleError(w, r, err, http.StatusBadRequest)
 		return
 	}
-
-	// Keep build hashes consistent with varying input
-	if goArch != "arm" {
-		goARM = ""
+	err = checkCaddyVersion(caddyVersion, orderedFeatures)
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
 	}
-
-	// Ensure required features are implicitly added
-	for _, plugin := range features.Registry {
-		if plugin.Required {
-			var found bool
-			for _, feat := range featureList {
-				if feat == plugin.Name {
-					found = true
-					break
-				}
-			}
-			if !found {
-				featureList = append(featureList, plugin.Name)
-			}
-		}
+	err = checkBuilder(Target{GoOS: goOS, GoArch: goArch, GoARM: goARM, CaddyVersion: caddyVersion, Plugins: orderedFeatures})
+	if err != nil {
+		handleError(w, r, err, http.StatusBadRequest)
+		return
 	}
-
-	// Put features in order to keep hashes consistent and for use in the codegen function
-	orderedFeatures := sortFeatures(featureList)
-
-	// Create 'hash' to identify this build
-	hash := buildHash(goOS, goArch, goARM, orderedFeatures.String())
-
-	// Get the path from which to download the file
-	buildsMutex.Lock()
-	b, ok := builds[hash]
-	buildsMutex.Unlock()
-
-	if ok {
-		// build exists; wait for it to complete if not done yet
-		<-b.DoneChan
-	} else {
-		// no build yet; reserve it so we don't duplicate the build job
-		ts := time.Now().Format("060201150405") // YearMonthDayHourMinSec
-		var downloadPath string
-		for {
-			// find a suitable random number not already in use
-			random := strconv.Itoa(rand.Intn(100) + 899)
-			downloadPath = filepath.Join(BuildPath, ts+random)
-			_, err := os.Stat(downloadPath)
-			if os.IsNotExist(err) {
-				break
-			}
-		}
-
-		// Determine the remaining build information and reserve the build job
-
-		downloadFileCompression := CompressTarGz
-		if goOS == "windows" || goOS == "darwin" {
-			downloadFileCompression = CompressZip
-		}
-
-		buildFilename := "caddy"
-		if goOS == "windows" {
-			buildFilename += ".exe"
+	compression := -1 // the build's own format
+	if format != "" {
+		compression, err = checkFormat(format, goOS, goArch, goARM)
+		if err != nil {
+			handleError(w, r, err, http.StatusBadRequest)
+			return
 		}
+	}
 
-		downloadFilename := "caddy_" + goOS + "_" + goArch + "_custom"
-		if downloadFileCompression == CompressZip {
-			downloadFilename += ".zip"
-		} else {
-			downloadFilename += ".tar.gz"
-		}
+	b, created := reserveBuild(goOS, goArch, goARM, caddyVersion, orderedFeatures)
+	hash := b.Hash
 
-		b = &Build{
-			DoneChan:                make(chan struct{}),
-			OutputFile:              downloadPath + "/" + buildFilename,
-			DownloadFile:            downloadPath + "/" + downloadFilename,
-			DownloadFilename:        downloadFilename,
-			DownloadFileCompression: downloadFileCompression,
-			GoOS:     goOS,
-			GoArch:   goArch,
-			GoARM:    goARM,
-			Features: orderedFeatures,
-			Hash:     hash,
+	if created {
+		b.RequestID = requestID(r)
+		err = queue.enqueue(b)
+		if err != nil {
+			// fail the job, rather than deleting it, so
+			// requests that joined it don't wait forever
+			b.cancel(err)
+			w.Header().Set("Retry-After", queueRetryAfter)
+			handleError(w, r, err, http.StatusServiceUnavailable)
+			return
 		}
+	}
 
-		// Save the build, indicating currently in progress
-		buildsMutex.Lock()
-		builds[hash] = b
-		buildsMutex.Unlock()
-
-		// Perform build (blocking)
-		err = b.Build()
-		if err != nil {
-			handleError(w, r, err, http.StatusInternalServerError)
-			deleteBuildJob(hash) // delete the build; it didn't succeed
+	// wait for the build to complete if not done yet,
+	// unless the client would rather poll for it
+	select {
+	case <-b.DoneChan:
+	default:
+		if preferAsync(r) {
+			w.Header().Set("Preference-Applied", "respond-async")
+			w.Header().Set("Location", APIBuildsPath+"/"+b.ID)
+			writeJobStatus(w, b, http.StatusAccepted)
 			return
 		}
+		<-b.DoneChan
+	}
+	if err := b.Err(); notQueued(err) {
+		w.Header().Set("Retry-After", queueRetryAfter)
+		handleError(w, r, err, http.StatusServiceUnavailable)
+		return
+	}
+	if b.State() == JobFailed {
+		// point the client at the output so they can find out why
+		logWarn("requested build failed", "request_id", requestID(r), "status", http.StatusInternalServerError,
+			"url", r.URL.String(), "job", b.ID, "hash", b.Hash)
+		http.Error(w, "build failed; see "+APIBuildsPath+"/"+b.ID+"/log for details", http.StatusInternalServerError)
+		return
 	}
 
 	// Update our copy of the build information
 	buildsMutex.Lock()
-	b, ok = builds[hash]
+	b, ok := builds[hash]
 	buildsMutex.Unlock()
 	if !ok {
 		handleError(w, r, errors.New("Build doesn't exist"), http.StatusInternalServerError)
 		return
 	}
 
-	// Open download file
-	f, err := os.Open(b.DownloadFile)
+	// Get the build in the requested format; other formats
+	// are made from the same binary, without building again
+	if compression < 0 {
+		compression = b.DownloadFileCompression
+	}
+	a, err := b.artifact(compression)
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+
+	// Open download file; if it was evicted in the
+	// meantime, it's made again from the binary
+	f, err := os.Open(a.File)
+	if os.IsNotExist(err) && compression != b.DownloadFileCompression {
+		a, err = b.artifact(compression)
+		if err == nil {
+			f, err = os.Open(a.File)
+		}
+	}
 	if err != nil {
 		handleError(w, r, err, http.StatusInternalServerError)
-		deleteBuildJob(hash)
 		return
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		handleError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	b.touch()
 
-	w.Header().Set("Location", "/download/"+b.DownloadFile)
+	w.Header().Set("Location", buildFileURL(a.File))
+	w.Header().Set("Digest", digestHeader(a.Checksum))
+	w.Header().Set("ETag", etag(a.Checksum))
 	w.Header().Set("Expires", b.Expires.Format(http.TimeFormat))
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+b.DownloadFilename+"\"")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+a.Filename+"\"")
+
+	// Takes care of HEAD, range and conditional requests
+	http.ServeContent(countingWriter{w}, r, a.Filename, info.ModTime(), f)
+}
 
-	if ok {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusCreated)
+// reserveBuild returns the build job for the given, already validated,
+// input; orderedFeatures are the resolved plugins in registry order
+// and caddyVersion is the chosen Caddy version, if any.
+// If an identical build already exists (finished or not), that
+// one is returned and created is false. Otherwise a new job is reserved
+// in the queued state; the caller is responsible for running it.
+func reserveBuild(goOS, goArch, goARM, caddyVersion string, orderedFeatures features.Plugins) (b *Build, created bool) {
+	// Keep build hashes consistent with varying input
+	if goArch != "arm" {
+		goARM = ""
+	}
+
+	// Create 'hash' to identify this build
+	hash := buildHash(goOS, goArch, goARM, buildFeatures(caddyVersion, orderedFeatures))
+	defer func() {
+		recordBuildRequest(orderedFeatures, created)
+	}()
+
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+
+	if b, ok := builds[hash]; ok {
+		return b, false
+	}
+
+	// no build yet; reserve it so we don't duplicate the build job
+	ts := time.Now().Format("060201150405") // YearMonthDayHourMinSec
+	var downloadPath string
+	for {
+		// find a suitable random number not already in use, by
+		// a build on disk or by a job that hasn't made its folder
+		random := strconv.Itoa(rand.Intn(100) + 899)
+		downloadPath = filepath.Join(BuildPath, ts+random)
+		_, err := os.Stat(downloadPath)
+		if os.IsNotExist(err) && !pathReserved(downloadPath) {
+			break
+		}
 	}
 
-	if r.Method == "GET" {
-		io.Copy(w, f)
+	// Determine the remaining build information and reserve the build job
+	platform, _ := allowed.get(goOS, goArch)
+	downloadFileCompression := platform.compression()
+	buildFilename := "caddy" + platform.Exe
+
+	downloadFilename := "caddy_"
+	if caddyVersion != "" {
+		downloadFilename += caddyVersion + "_"
+	}
+	downloadFilename += goOS + "_" + goArch + "_custom" + formatExt(downloadFileCompression)
+	downloadFile := downloadPath + "/" + downloadFilename
+	if downloadFileCompression == CompressNone {
+		downloadFilename += platform.Exe
+		downloadFile = downloadPath + "/" + buildFilename
 	}
+
+	b = &Build{
+		ID:                      newJobID(),
+		DoneChan:                make(chan struct{}),
+		OutputFile:              downloadPath + "/" + buildFilename,
+		DownloadFile:            downloadFile,
+		LogFile:                 downloadPath + "/build.log",
+		DownloadFilename:        downloadFilename,
+		DownloadFileCompression: downloadFileCompression,
+		GoOS:                    goOS,
+		GoArch:                  goArch,
+		GoARM:                   goARM,
+		CaddyVersion:            caddyVersion,
+		Features:                orderedFeatures,
+		Hash:                    hash,
+		Created:                 time.Now(),
+		platform:                platform,
+		state:                   JobQueued,
+		output:                  newBuildLog(),
+	}
+
+	// Save the build, indicating currently in progress
+	builds[hash] = b
+	jobs[b.ID] = b
+
+	return b, true
+}
+
+// pathReserved returns whether a build job already has its
+// files in the folder at path. buildsMutex must be locked.
+func pathReserved(path string) bool {
+	for _, b := range jobs {
+		if filepath.Dir(b.OutputFile) == path {
+			return true
+		}
+	}
+	return false
 }
 
-// deleteBuild deletes a build from the map.
+// deleteBuildJob deletes a build from the maps.
 // It is safe for concurrent use. It does NOT
 // delete the build from the file system.
 func deleteBuildJob(hash string) {
 	buildsMutex.Lock()
+	if b, ok := builds[hash]; ok {
+		delete(jobs, b.ID)
+	}
 	delete(builds, hash)
 	buildsMutex.Unlock()
 }
 
+// preferAsync returns whether r has a Prefer
+// header with the respond-async preference.
+func preferAsync(r *http.Request) bool {
+	for _, header := range r.Header["Prefer"] {
+		for _, pref := range strings.Split(header, ",") {
+			if i := strings.Index(pref, ";"); i > -1 {
+				pref = pref[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // checkInput checks the arguments for valid values and returns an error
-// if any one of them is invalid.
-func checkInput(goOS, goArch, goARM string, featureList []string) error {
+// if any one of them is invalid. Otherwise, it returns the plugins to
+// build with: the features in featureList, the required features and
+// their dependencies, in registry order.
+func checkInput(goOS, goArch, goARM string, featureList []string) (features.Plugins, error) {
 	// Check for required fields
 	if goOS == "" {
-		return errors.New("missing os parameter")
+		return nil, errors.New("missing os parameter")
 	}
 	if goArch == "" {
-		return errors.New("missing arch parameter")
+		return nil, errors.New("missing arch parameter")
 	}
 
 	// Check for valid input
 	if !allowed.valid(goOS, goArch) {
-		return errors.New(goOS + "/" + goArch + " not supported")
+		return nil, errors.New(goOS + "/" + goArch + " not supported")
 	}
 	if goARM != "" && !allowedARM.contains(goARM) {
-		return errors.New("arm version not supported")
+		return nil, errors.New("arm version not supported")
 	}
 
-	// Check features
-	for _, feature := range featureList {
-		if !features.Registry.Contains(feature) {
-			return errors.New("unknown feature '" + feature + "'")
-		}
+	// Check features; add required features and dependencies, and put
+	// them in order to keep hashes consistent and for use in the codegen
+	orderedFeatures, err := features.Current().Resolve(featureList)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil
-}
-
-// sortFeatures sorts features to the order in which they are registered.
-func sortFeatures(featureList []string) features.Plugins {
-	var orderedFeatures features.Plugins
-loop:
-	for _, m := range features.Registry {
-		for _, feature := range featureList {
-			if feature == m.Name {
-				orderedFeatures = append(orderedFeatures, m)
-				continue loop
-			}
+	for _, plugin := range orderedFeatures {
+		if !plugin.SupportsPlatform(goOS, goArch) {
+			return nil, errors.New("feature '" + plugin.Name + "' not supported on " + goOS + "/" + goArch)
 		}
 	}
-	return orderedFeatures
-}
 
-const (
-	CompressZip = iota
-	CompressTarGz
-)
+	return orderedFeatures, nil
+}
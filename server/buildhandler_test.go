@@ -1,45 +1,352 @@
 package server
 
-import "testing"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// useFakeBuilds makes builds use FakeBuilder and a temporary
+// BuildPath until the returned function is called.
+func useFakeBuilds(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldBuilder, oldPath := DefaultBuilder, BuildPath
+	DefaultBuilder, BuildPath = FakeBuilder{}, dir
+	return func() {
+		DefaultBuilder, BuildPath = oldBuilder, oldPath
+		os.RemoveAll(dir)
+	}
+}
 
 func TestBuildHandler(t *testing.T) {
-	// TODO: Hmm, how to test this cleanly.
-	// Maybe simple error cases, like missing query string parameters
+	defer useFakeBuilds(t)()
+
+	for i, test := range []struct {
+		query          string
+		expectedStatus int
+	}{
+		{"", http.StatusBadRequest},
+		{"?os=linux", http.StatusBadRequest},
+		{"?os=linux&arch=amd64&features=nope", http.StatusBadRequest},
+		{"?os=linux&arch=amd64&features=git", http.StatusOK},
+		{"?os=linux&arch=amd64&features=git", http.StatusOK}, // cached
+		{"?os=windows&arch=amd64", http.StatusOK},
+	} {
+		req := httptest.NewRequest("GET", "/download/build"+test.query, nil)
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, req)
+
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d: %s", i, test.expectedStatus, rec.Code, rec.Body.String())
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		if rec.Body.Len() == 0 {
+			t.Errorf("Test %d: Expected archive in body, but body was empty", i)
+		}
+		if rec.Header().Get("Digest") == "" {
+			t.Errorf("Test %d: Expected Digest header, but there wasn't one", i)
+		}
+	}
+
+	buildsMutex.Lock()
+	var hashes []string
+	for hash := range builds {
+		hashes = append(hashes, hash)
+	}
+	buildsMutex.Unlock()
+	if len(hashes) != 2 {
+		t.Errorf("Expected 2 builds, got %d: %v", len(hashes), hashes)
+	}
+	for _, hash := range hashes {
+		deleteBuildJob(hash)
+	}
+}
+
+func TestBuildHandlerUnbuildable(t *testing.T) {
+	defer useFakeBuilds(t)()
+	DefaultBuilder = ModuleBuilder{
+		CaddyMain: "example.com/caddy/main",
+		Requires:  map[string]string{"example.com/caddy": "v1.0.0"},
+	}
+
+	for i, test := range []struct {
+		query, body string
+	}{
+		{"?os=linux&arch=amd64&features=git", `{"os": "linux", "arch": "amd64", "features": ["git"]}`},
+		{"?os=linux&arch=amd64&features=git@master", `{"os": "linux", "arch": "amd64", "features": ["git@master"]}`},
+	} {
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, httptest.NewRequest("GET", "/download/build"+test.query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Test %d: Expected status %d for the download, got %d", i, http.StatusBadRequest, rec.Code)
+		}
+		rec = httptest.NewRecorder()
+		BuildsAPIHandler(rec, httptest.NewRequest("POST", APIBuildsPath, strings.NewReader(test.body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Test %d: Expected status %d for the job, got %d", i, http.StatusBadRequest, rec.Code)
+		}
+	}
+
+	// nothing was queued
+	buildsMutex.Lock()
+	n := len(builds)
+	buildsMutex.Unlock()
+	if n != 0 {
+		t.Errorf("Expected no builds, got %d", n)
+	}
+}
+
+func TestBuildsAPIEndToEnd(t *testing.T) {
+	defer useFakeBuilds(t)()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(APIBuildsPath, BuildsAPIHandler)
+	mux.HandleFunc(APIBuildsPath+"/", BuildsAPIHandler)
+	mux.Handle(BuildFilesPath, BuildFilesHandler(BuildFilesPath))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+APIBuildsPath, "application/json",
+		strings.NewReader(`{"os": "linux", "arch": "arm", "arm": "6", "features": ["git"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var js jobStatus
+	json.NewDecoder(resp.Body).Decode(&js)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d", resp.StatusCode)
+	}
+	defer deleteBuildJob(buildHash("linux", "arm", "6", "HTTP,git"))
+
+	// Poll until done
+	deadline := time.Now().Add(10 * time.Second)
+	for js.State != JobSucceeded && js.State != JobFailed && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		resp, err := http.Get(srv.URL + resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewDecoder(resp.Body).Decode(&js)
+		resp.Body.Close()
+	}
+	if js.State != JobSucceeded {
+		t.Fatalf("Expected build to succeed, got state '%s'", js.State)
+	}
+
+	// Download the build
+	resp, err = http.Get(srv.URL + js.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(archive) == 0 {
+		t.Fatalf("Expected to download archive, got status %d with %d bytes", resp.StatusCode, len(archive))
+	}
+	sum := sha256.Sum256(archive)
+	if hex.EncodeToString(sum[:]) != js.Checksum {
+		t.Error("Expected downloaded archive to match checksum")
+	}
+
+	// Follow the log
+	resp, err = http.Get(srv.URL + js.LogURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logData, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(logData), "fake build for linux/arm") {
+		t.Errorf("Expected builder output in log, got:\n%s", logData)
+	}
+	if !strings.HasSuffix(string(logData), "event: end\ndata: succeeded\n\n") {
+		t.Errorf("Expected log to end with end event, got:\n%s", logData)
+	}
 }
 
 func TestCheckInput(t *testing.T) {
-	err := checkInput("linux", "amd64", "", nil)
+	_, err := checkInput("linux", "amd64", "", nil)
 	if err != nil {
 		t.Errorf("Expected no errors when input is good, but got '%v'", err)
 	}
 
-	err = checkInput("", "amd64", "", nil)
+	_, err = checkInput("", "amd64", "", nil)
 	if err == nil {
 		t.Error("Expected error when os missing")
 	}
 
-	err = checkInput("linux", "", "", nil)
+	_, err = checkInput("linux", "", "", nil)
 	if err == nil {
 		t.Error("Expected error when arch missing")
 	}
 
-	err = checkInput("bad_os", "amd64", "", nil)
+	_, err = checkInput("bad_os", "amd64", "", nil)
 	if err == nil {
 		t.Error("Expected error when os is invalid")
 	}
 
-	err = checkInput("linux", "bad_arch", "", nil)
+	_, err = checkInput("linux", "bad_arch", "", nil)
 	if err == nil {
 		t.Error("Expected error when arch is invalid")
 	}
 
-	err = checkInput("linux", "amd64", "bad_arm", nil)
+	_, err = checkInput("linux", "amd64", "bad_arm", nil)
 	if err == nil {
 		t.Error("Expected error when arm is invalid")
 	}
 
-	err = checkInput("linux", "amd64", "", []string{"alsdjfkaskldfjsjhfskdjhfskdjfhhkjhsk"})
+	_, err = checkInput("linux", "amd64", "", []string{"alsdjfkaskldfjsjhfskdjhfskdjfhhkjhsk"})
 	if err == nil {
 		t.Error("Expected error when a feature is invalid")
 	}
+
+	_, err = checkInput("linux", "amd64", "", []string{"git@$(reboot)"})
+	if err == nil {
+		t.Error("Expected error when a feature version is invalid")
+	}
+}
+
+func TestBuildHashVersions(t *testing.T) {
+	unpinned, err := checkInput("linux", "amd64", "", []string{"git"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	pinned, err := checkInput("linux", "amd64", "", []string{"git@v1.2.0"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if buildHash("linux", "amd64", "", unpinned.SpecString()) == buildHash("linux", "amd64", "", pinned.SpecString()) {
+		t.Error("Expected builds of different plugin versions to have different hashes")
+	}
+	if !strings.Contains(pinned.SpecString(), "git@v1.2.0") {
+		t.Errorf("Expected pinned version in specs, got '%s'", pinned.SpecString())
+	}
+}
+
+func TestCheckInputPlatform(t *testing.T) {
+	plugins, err := checkInput("linux", "amd64", "", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !plugins.Contains("HTTP") {
+		t.Error("Expected required feature to be added")
+	}
+
+	currentRegistry := features.Current()
+	registry := append(features.Plugins{}, currentRegistry...)
+	registry = append(registry, features.Plugin{
+		Type:      features.DirectivePlugin,
+		Name:      "linuxonly",
+		Import:    "example.com/linuxonly",
+		Platforms: []string{"linux/*"},
+	})
+	features.Set(registry)
+	defer features.Set(currentRegistry)
+
+	_, err = checkInput("linux", "amd64", "", []string{"linuxonly"})
+	if err != nil {
+		t.Errorf("Expected no error for supported platform, got %v", err)
+	}
+	_, err = checkInput("windows", "amd64", "", []string{"linuxonly"})
+	if err == nil {
+		t.Error("Expected error for unsupported platform")
+	}
+}
+
+func TestBuildHandlerDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A finished build to download
+	orderedFeatures, err := checkInput("linux", "amd64", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Build{
+		ID:               "downloadid",
+		DoneChan:         make(chan struct{}),
+		DownloadFile:     filepath.Join(dir, "caddy_linux_amd64_custom.tar.gz"),
+		DownloadFilename: "caddy_linux_amd64_custom.tar.gz",
+		GoOS:             "linux",
+		GoArch:           "amd64",
+		Features:         orderedFeatures,
+		Hash:             buildHash("linux", "amd64", "", orderedFeatures.String()),
+		state:            JobSucceeded,
+	}
+	close(b.DoneChan)
+	ioutil.WriteFile(b.DownloadFile, []byte("0123456789"), 0644)
+	b.Checksum, _ = checksumFile(b.DownloadFile)
+	buildsMutex.Lock()
+	builds[b.Hash] = b
+	jobs[b.ID] = b
+	buildsMutex.Unlock()
+	defer deleteBuildJob(b.Hash)
+
+	for i, test := range []struct {
+		method         string
+		headers        map[string]string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"GET", nil, http.StatusOK, "0123456789"},
+		{"HEAD", nil, http.StatusOK, ""},
+		{"GET", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{"GET", map[string]string{"If-None-Match": etag(b.Checksum)}, http.StatusNotModified, ""},
+		{"GET", map[string]string{"If-None-Match": `"something-else"`}, http.StatusOK, "0123456789"},
+		{"GET", map[string]string{"Range": "bytes=2-4", "If-Range": `"something-else"`}, http.StatusOK, "0123456789"},
+	} {
+		req := httptest.NewRequest(test.method, "/download/build?os=linux&arch=amd64", nil)
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, req)
+
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, rec.Code)
+		}
+		if body := rec.Body.String(); body != test.expectedBody {
+			t.Errorf("Test %d: Expected body '%s', got '%s'", i, test.expectedBody, body)
+		}
+		if tag := rec.Header().Get("ETag"); tag != etag(b.Checksum) {
+			t.Errorf("Test %d: Expected ETag %s, got %s", i, etag(b.Checksum), tag)
+		}
+		if test.method == "HEAD" && rec.Header().Get("Content-Length") != "10" {
+			t.Errorf("Test %d: Expected Content-Length 10, got '%s'", i, rec.Header().Get("Content-Length"))
+		}
+	}
+
+	// a download that can't be opened is an error,
+	// but the build is kept
+	os.Remove(b.DownloadFile)
+	rec := httptest.NewRecorder()
+	BuildHandler(rec, httptest.NewRequest("GET", "/download/build?os=linux&arch=amd64", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d for a missing download, got %d", http.StatusInternalServerError, rec.Code)
+	}
+	buildsMutex.Lock()
+	_, ok := builds[b.Hash]
+	buildsMutex.Unlock()
+	if !ok {
+		t.Error("Expected the build to be kept, but it was deleted")
+	}
 }
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// buildInfoFilename is the name of the file in each archive
+// that describes how the build inside it was made.
+const buildInfoFilename = "BUILDINFO.json"
+
+// buildInfo is the machine-readable description of a build
+// that is included in every archive, mostly so that support
+// requests can be triaged from the archive alone.
+type buildInfo struct {
+	Hash      string        `json:"hash"`
+	GoOS      string        `json:"os"`
+	GoArch    string        `json:"arch"`
+	GoARM     string        `json:"arm,omitempty"` // as built, for arm
+	GoVersion string        `json:"go_version"`
+	Caddy     componentInfo `json:"caddy"`
+	Plugins   []pluginInfo  `json:"plugins"`
+	Built     time.Time     `json:"built"`
+}
+
+// componentInfo identifies a package and the revision of
+// its repository that was built or, for module builds, the
+// module it is in and the version of it that was resolved.
+type componentInfo struct {
+	Import   string `json:"import"`
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Module   string `json:"module,omitempty"`
+}
+
+// pluginInfo is a plugin that is part of a build.
+type pluginInfo struct {
+	Name string `json:"name"`
+	componentInfo
+}
+
+// writeBuildInfo writes the build info of b to path as JSON.
+func (b *Build) writeBuildInfo(path string) error {
+	srcPath := strings.TrimSuffix(CaddyPath, MainCaddyPackage)
+
+	info := buildInfo{
+		Hash:      b.Hash,
+		GoOS:      b.GoOS,
+		GoArch:    b.GoArch,
+		GoARM:     b.target().goARM(),
+		GoVersion: goVersion(),
+		Caddy: componentInfo{
+			Import:   MainCaddyPackage,
+			Version:  b.CaddyVersion,
+			Revision: vcsRevision(CaddyPath, "HEAD"),
+		},
+		Plugins: make([]pluginInfo, len(b.Features)),
+		Built:   time.Now().UTC(),
+	}
+	for i, plugin := range b.Features {
+		info.Plugins[i] = pluginInfo{
+			Name: plugin.Name,
+			componentInfo: componentInfo{
+				Import:   plugin.Import,
+				Version:  plugin.Version,
+				Revision: vcsRevision(filepath.Join(srcPath, plugin.Import), "HEAD"),
+			},
+		}
+	}
+
+	// module builds don't use the GOPATH checkouts; describe
+	// the modules that went into the binary instead
+	if _, ok := DefaultBuilder.(ModuleBuilder); ok {
+		modules := binaryModules(b.OutputFile)
+		info.Caddy.setModule(modules)
+		for i := range info.Plugins {
+			info.Plugins[i].setModule(modules)
+		}
+	}
+
+	data, err := json.MarshalIndent(info, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// goVersion returns the version of the Go toolchain that
+// builds are made with, like "go1.6.2", or "" if unknown.
+func goVersion() string {
+	out, err := exec.Command("go", "version").Output()
+	if err != nil {
+		return ""
+	}
+	// output is like "go version go1.6.2 linux/amd64"
+	fields := strings.Fields(string(out))
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+// vcsRevision returns the commit that rev refers to in the
+// git repository that contains dir, or "" if there is none.
+func vcsRevision(dir, rev string) string {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// setModule replaces the revision of c with the module that
+// contains it and its version, from modules (as returned by
+// binaryModules), if one of them does.
+func (c *componentInfo) setModule(modules map[string]string) {
+	c.Revision, c.Module = "", ""
+	for path, version := range modules {
+		if (c.Import == path || strings.HasPrefix(c.Import, path+"/")) && len(path) > len(c.Module) {
+			c.Module, c.Version = path, version
+		}
+	}
+}
+
+// binaryModules returns the versions of the modules that the
+// Go binary at path was built with, by module path, or nil if
+// they can't be read.
+func binaryModules(path string) map[string]string {
+	out, err := exec.Command("go", "version", "-m", path).Output()
+	if err != nil {
+		return nil
+	}
+	return parseModules(string(out))
+}
+
+// parseModules parses the output of "go version -m". The
+// version of a replaced module is that of its replacement.
+func parseModules(out string) map[string]string {
+	modules := make(map[string]string)
+	var last string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[0] {
+		case "mod", "dep":
+			last = fields[1]
+			modules[last] = fields[2]
+		case "=>":
+			if last != "" {
+				modules[last] = fields[2]
+			}
+		}
+	}
+	return modules
+}
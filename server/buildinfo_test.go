@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+func TestWriteBuildInfoARM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		goArch, goARM, expected string
+	}{
+		{"arm", "6", "6"},
+		{"arm", "", "7"}, // defaultARM
+		{"amd64", "", ""},
+	} {
+		b := &Build{GoOS: "linux", GoArch: test.goArch, GoARM: test.goARM}
+		path := filepath.Join(dir, buildInfoFilename)
+		if err := b.writeBuildInfo(path); err != nil {
+			t.Fatalf("Test %d: Expected no error, got %v", i, err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info buildInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			t.Fatalf("Test %d: Expected valid JSON, got error: %v", i, err)
+		}
+		if info.GoARM != test.expected {
+			t.Errorf("Test %d: Expected GOARM '%s', got '%s'", i, test.expected, info.GoARM)
+		}
+	}
+}
+
+func TestWriteBuildInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &Build{
+		GoOS:   "linux",
+		GoArch: "arm",
+		GoARM:  "7",
+		Hash:   "linux:arm:7:HTTP,git",
+		Features: features.Plugins{
+			{Name: "HTTP", Import: "github.com/mholt/caddy/caddyhttp"},
+			{Name: "git", Import: "github.com/abiosoft/caddy-git"},
+		},
+	}
+	path := filepath.Join(dir, buildInfoFilename)
+	err = b.writeBuildInfo(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info buildInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		t.Fatalf("Expected valid JSON, got error: %v", err)
+	}
+
+	if info.Hash != b.Hash {
+		t.Errorf("Expected hash %s, got %s", b.Hash, info.Hash)
+	}
+	if info.GoOS != "linux" || info.GoArch != "arm" || info.GoARM != "7" {
+		t.Errorf("Expected platform linux/arm/7, got %s/%s/%s", info.GoOS, info.GoArch, info.GoARM)
+	}
+	if info.Caddy.Import != MainCaddyPackage {
+		t.Errorf("Expected Caddy import %s, got %s", MainCaddyPackage, info.Caddy.Import)
+	}
+	if len(info.Plugins) != 2 {
+		t.Fatalf("Expected 2 plugins, got %d", len(info.Plugins))
+	}
+	if info.Plugins[1].Name != "git" || info.Plugins[1].Import != "github.com/abiosoft/caddy-git" {
+		t.Errorf("Unexpected plugin info: %+v", info.Plugins[1])
+	}
+}
+
+func TestParseModules(t *testing.T) {
+	out := "/tmp/caddy: go1.12.5\n" +
+		"\tpath\tcaddy\n" +
+		"\tmod\tcaddy\t(devel)\t\n" +
+		"\tdep\tgithub.com/mholt/caddy\tv0.11.5\th1:abc=\n" +
+		"\tdep\tgithub.com/abiosoft/caddy-git\tv0.0.0-20190224035133-8feb7bc6bdb6\n" +
+		"\t=>\tgithub.com/fork/caddy-git\tv1.0.1\th1:def=\n" +
+		"\tdep\tgithub.com/abiosoft/caddy-git/sub\tv1.1.0\n" +
+		"\tbuild\tGOOS=linux\n"
+	expected := map[string]string{
+		"caddy":                             "(devel)",
+		"github.com/mholt/caddy":            "v0.11.5",
+		"github.com/abiosoft/caddy-git":     "v1.0.1",
+		"github.com/abiosoft/caddy-git/sub": "v1.1.0",
+	}
+	modules := parseModules(out)
+	if !reflect.DeepEqual(modules, expected) {
+		t.Errorf("Expected %v, got %v", expected, modules)
+	}
+
+	for i, test := range []struct {
+		imp, expectModule, expectVersion string
+	}{
+		{"github.com/mholt/caddy/caddyhttp", "github.com/mholt/caddy", "v0.11.5"},
+		{"github.com/abiosoft/caddy-git", "github.com/abiosoft/caddy-git", "v1.0.1"},
+		{"github.com/abiosoft/caddy-git/sub/pkg", "github.com/abiosoft/caddy-git/sub", "v1.1.0"},
+		{"github.com/abiosoft/caddy-gitlab", "", "v2"}, // not a module in the binary
+	} {
+		c := componentInfo{Import: test.imp, Version: "v2", Revision: "0123abc"}
+		c.setModule(modules)
+		if c.Module != test.expectModule || c.Version != test.expectVersion {
+			t.Errorf("Test %d: Expected module %s %s, got %s %s", i, test.expectModule, test.expectVersion, c.Module, c.Version)
+		}
+		if c.Revision != "" {
+			t.Errorf("Test %d: Expected no GOPATH revision, got %s", i, c.Revision)
+		}
+	}
+}
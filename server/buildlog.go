@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// buildLog collects the output of a build job in memory
+// so it can be followed while the job runs. It is safe
+// for concurrent use. A nil *buildLog discards writes.
+type buildLog struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+	update chan struct{} // closed (and replaced) when buf grows or the log is closed
+}
+
+func newBuildLog() *buildLog {
+	return &buildLog{update: make(chan struct{})}
+}
+
+// Write appends p to the log and wakes up any readers.
+func (l *buildLog) Write(p []byte) (int, error) {
+	if l == nil {
+		return len(p), nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, fmt.Errorf("build log is closed")
+	}
+	l.buf.Write(p)
+	close(l.update)
+	l.update = make(chan struct{})
+	return len(p), nil
+}
+
+// Printf writes a timestamped line to the log.
+func (l *buildLog) Printf(format string, args ...interface{}) {
+	line := time.Now().UTC().Format("2006/01/02 15:04:05 ") + fmt.Sprintf(format, args...)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line += "\n"
+	}
+	l.Write([]byte(line))
+}
+
+// Close marks the log as complete; nothing
+// more can be written to it after that.
+func (l *buildLog) Close() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.update)
+	}
+}
+
+// read returns the complete lines of the log starting at
+// offset, whether the log is closed, and a channel that is
+// closed when there is something new to read. Once the log
+// is closed, a trailing partial line is returned too.
+func (l *buildLog) read(offset int) (data []byte, closed bool, update <-chan struct{}) {
+	if l == nil {
+		return nil, true, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if offset < l.buf.Len() {
+		data = l.buf.Bytes()[offset:]
+		if !l.closed {
+			data = data[:bytes.LastIndexByte(data, '\n')+1]
+		}
+		data = append([]byte(nil), data...)
+	}
+	return data, l.closed, l.update
+}
+
+// save writes the contents of the log to the file at path.
+func (l *buildLog) save(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ioutil.WriteFile(path, l.buf.Bytes(), 0644)
+}
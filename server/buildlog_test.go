@@ -0,0 +1,47 @@
+package server
+
+import "testing"
+
+func TestBuildLog(t *testing.T) {
+	l := newBuildLog()
+	l.Write([]byte("line one\nline t"))
+
+	data, closed, update := l.read(0)
+	if string(data) != "line one\n" {
+		t.Errorf("Expected only the complete line, got '%s'", data)
+	}
+	if closed {
+		t.Error("Expected log to be open")
+	}
+
+	l.Write([]byte("wo\n"))
+	select {
+	case <-update:
+	default:
+		t.Error("Expected update channel to be closed after a write")
+	}
+
+	data, _, _ = l.read(len("line one\n"))
+	if string(data) != "line two\n" {
+		t.Errorf("Expected second line, got '%s'", data)
+	}
+
+	l.Write([]byte("partial"))
+	l.Close()
+	data, closed, _ = l.read(len("line one\nline two\n"))
+	if string(data) != "partial" {
+		t.Errorf("Expected trailing partial line once closed, got '%s'", data)
+	}
+	if !closed {
+		t.Error("Expected log to be closed")
+	}
+	if _, err := l.Write([]byte("more")); err == nil {
+		t.Error("Expected error writing to closed log")
+	}
+
+	var nilLog *buildLog
+	nilLog.Printf("discarded")
+	if _, closed, _ := nilLog.read(0); !closed {
+		t.Error("Expected nil log to read as closed")
+	}
+}
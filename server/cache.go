@@ -0,0 +1,201 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// evictMutex makes sure only one eviction runs at a time.
+var evictMutex sync.Mutex
+
+// ManageCache evicts finished builds according to BuildExpiry
+// and CacheQuota every interval, forever. Builds are also
+// evicted as needed whenever a new build finishes.
+func ManageCache(interval time.Duration) {
+	for {
+		evictBuilds(nil)
+		time.Sleep(interval)
+	}
+}
+
+// BuildFilesPath is the path at which BuildFilesHandler is
+// expected to be mounted; download URLs are made with it.
+const BuildFilesPath = "/download/builds/"
+
+// buildFileURL returns the URL path at which the file at
+// path, which must be inside BuildPath, is downloaded.
+func buildFileURL(path string) string {
+	rel, err := filepath.Rel(BuildPath, path)
+	if err != nil {
+		rel = filepath.Base(path)
+	}
+	return BuildFilesPath + filepath.ToSlash(rel)
+}
+
+// BuildFilesHandler serves the files of finished builds from
+// BuildPath to requests whose path begins with prefix. It keeps
+// track of when each build was last downloaded so the least
+// recently used ones are evicted first. Like BuildHandler, it
+// supports range and conditional requests.
+func BuildFilesHandler(prefix string) http.Handler {
+	fileServer := http.StripPrefix(prefix, http.FileServer(http.Dir(BuildPath)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.Path, prefix)
+		dir := strings.SplitN(file, "/", 2)[0]
+		if b := buildInDir(filepath.Join(BuildPath, dir)); b != nil {
+			b.touch()
+			if a, ok := b.artifactByFile(filepath.Join(BuildPath, filepath.FromSlash(file))); ok {
+				w.Header().Set("ETag", etag(a.Checksum))
+				w.Header().Set("Digest", digestHeader(a.Checksum))
+			}
+		}
+		fileServer.ServeHTTP(countingWriter{w}, r)
+	})
+}
+
+// touch records that b was just accessed.
+func (b *Build) touch() {
+	b.mu.Lock()
+	b.lastAccess = time.Now()
+	b.mu.Unlock()
+}
+
+// buildInDir returns the build whose files are in dir, or nil.
+func buildInDir(dir string) *Build {
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+	for _, b := range builds {
+		if filepath.Dir(b.DownloadFile) == dir {
+			return b
+		}
+	}
+	return nil
+}
+
+// candidate is a build that may be evicted.
+type candidate struct {
+	b                   *Build
+	size                int64
+	lastAccess, expires time.Time
+}
+
+// evictBuilds deletes finished builds that are older than
+// BuildExpiry. Then, until the total size of builds is within
+// CacheQuota, it deletes the least recently accessed artifacts
+// that were packaged from binaries, and after those the least
+// recently accessed builds. The build keep, if not nil, is
+// never evicted, nor are its artifacts.
+func evictBuilds(keep *Build) {
+	evictMutex.Lock()
+	defer evictMutex.Unlock()
+
+	buildsMutex.Lock()
+	var candidates []candidate
+	for _, b := range builds {
+		if b == keep {
+			continue
+		}
+		b.mu.Lock()
+		if b.state == JobSucceeded {
+			candidates = append(candidates, candidate{b, b.size, b.lastAccess, b.Expires})
+		}
+		b.mu.Unlock()
+	}
+	buildsMutex.Unlock()
+
+	// Remove expired builds first
+	now := time.Now()
+	var total int64
+	var live []candidate
+	for _, c := range candidates {
+		if !c.expires.IsZero() && now.After(c.expires) {
+			removeBuild(c.b, "expired")
+			continue
+		}
+		total += c.size
+		live = append(live, c)
+	}
+
+	if CacheQuota <= 0 {
+		return
+	}
+	if keep != nil {
+		keep.mu.Lock()
+		total += keep.size
+		keep.mu.Unlock()
+	}
+
+	// Then packaged artifacts, since they are quick to
+	// make again, and the least recently used builds
+	if total > CacheQuota {
+		freed := evictArtifacts(live, total-CacheQuota)
+		for i := range live {
+			live[i].size -= freed[live[i].b]
+			total -= freed[live[i].b]
+		}
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].lastAccess.Before(live[j].lastAccess)
+	})
+	for i := 0; total > CacheQuota && i < len(live); i++ {
+		removeBuild(live[i].b, "over quota")
+		total -= live[i].size
+	}
+}
+
+// evictArtifacts deletes the least recently accessed artifacts
+// packaged from the binaries of builds until at least excess
+// bytes are freed, or there are no more. It returns how much
+// was freed from each build.
+func evictArtifacts(candidates []candidate, excess int64) map[*Build]int64 {
+	type packaged struct {
+		b *Build
+		a artifact
+	}
+	var all []packaged
+	for _, c := range candidates {
+		c.b.mu.Lock()
+		for _, a := range c.b.artifacts {
+			if a.File != c.b.OutputFile {
+				all = append(all, packaged{c.b, a})
+			}
+		}
+		c.b.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].a.lastAccess.Before(all[j].a.lastAccess)
+	})
+
+	freed := make(map[*Build]int64)
+	var total int64
+	for i := 0; total < excess && i < len(all); i++ {
+		logInfo("evicting artifact", "hash", all[i].b.Hash, "format", formatName(all[i].a.Compression))
+		size := all[i].b.dropArtifact(all[i].a.Compression)
+		freed[all[i].b] += size
+		total += size
+	}
+	return freed
+}
+
+// removeBuild deletes b from the maps and its files from disk.
+func removeBuild(b *Build, reason string) {
+	buildsMutex.Lock()
+	if builds[b.Hash] == b {
+		delete(builds, b.Hash)
+	}
+	if jobs[b.ID] == b {
+		delete(jobs, b.ID)
+	}
+	buildsMutex.Unlock()
+
+	logInfo("evicting build", "hash", b.Hash, "reason", reason)
+	err := os.RemoveAll(filepath.Dir(b.DownloadFile))
+	if err != nil {
+		logError("deleting build", "hash", b.Hash, "error", err)
+	}
+}
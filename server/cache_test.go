@@ -0,0 +1,157 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvictBuilds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldQuota := CacheQuota
+	CacheQuota = 250
+	defer func() { CacheQuota = oldQuota }()
+
+	now := time.Now()
+	newBuild := func(name string, lastAccess, expires time.Time) *Build {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		b := &Build{
+			ID:           name,
+			Hash:         name,
+			DownloadFile: filepath.Join(dir, name, "caddy.zip"),
+			Expires:      expires,
+			state:        JobSucceeded,
+			size:         100,
+			lastAccess:   lastAccess,
+		}
+		ioutil.WriteFile(b.DownloadFile, make([]byte, b.size), 0644)
+		buildsMutex.Lock()
+		builds[b.Hash] = b
+		jobs[b.ID] = b
+		buildsMutex.Unlock()
+		return b
+	}
+
+	expired := newBuild("expired", now, now.Add(-time.Minute))
+	oldest := newBuild("oldest", now.Add(-3*time.Hour), time.Time{})
+	older := newBuild("older", now.Add(-2*time.Hour), time.Time{})
+	recent := newBuild("recent", now.Add(-1*time.Hour), time.Time{})
+	kept := newBuild("kept", now.Add(-4*time.Hour), time.Time{})
+	defer func() {
+		for _, b := range []*Build{expired, oldest, older, recent, kept} {
+			deleteBuildJob(b.Hash)
+		}
+	}()
+
+	evictBuilds(kept)
+
+	for _, test := range []struct {
+		b       *Build
+		evicted bool
+	}{
+		{expired, true},
+		{oldest, true},
+		{older, true},
+		{recent, false},
+		{kept, false},
+	} {
+		buildsMutex.Lock()
+		_, inMap := builds[test.b.Hash]
+		buildsMutex.Unlock()
+		_, statErr := os.Stat(test.b.DownloadFile)
+		onDisk := statErr == nil
+
+		if test.evicted && (inMap || onDisk) {
+			t.Errorf("Expected build '%s' to be evicted, but it wasn't", test.b.ID)
+		}
+		if !test.evicted && (!inMap || !onDisk) {
+			t.Errorf("Expected build '%s' to be kept, but it wasn't", test.b.ID)
+		}
+	}
+}
+
+func TestEvictArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldQuota := CacheQuota
+	CacheQuota = 350 // 400 bytes on disk
+	defer func() { CacheQuota = oldQuota }()
+
+	now := time.Now()
+	b := &Build{
+		ID:           "packaged",
+		Hash:         "packaged",
+		OutputFile:   filepath.Join(dir, "caddy"),
+		DownloadFile: filepath.Join(dir, "caddy.tar.gz"),
+		state:        JobSucceeded,
+		lastAccess:   now,
+		artifacts:    make(map[int]artifact),
+	}
+	ioutil.WriteFile(b.OutputFile, make([]byte, 100), 0755)
+	ioutil.WriteFile(b.DownloadFile, make([]byte, 100), 0644)
+	for i, compression := range []int{CompressTarXz, CompressZip, CompressNone} {
+		a := artifact{
+			File:        filepath.Join(dir, "caddy"+formatExt(compression)),
+			Compression: compression,
+			size:        100,
+			lastAccess:  now.Add(time.Duration(i) * time.Hour),
+		}
+		if compression == CompressNone {
+			a.File = b.OutputFile
+		} else {
+			ioutil.WriteFile(a.File, make([]byte, a.size), 0644)
+		}
+		b.artifacts[compression] = a
+	}
+	b.updateSize()
+	buildsMutex.Lock()
+	builds[b.Hash] = b
+	jobs[b.ID] = b
+	buildsMutex.Unlock()
+	defer deleteBuildJob(b.Hash)
+
+	evictBuilds(nil)
+
+	buildsMutex.Lock()
+	_, inMap := builds[b.Hash]
+	buildsMutex.Unlock()
+	if !inMap {
+		t.Fatal("Expected build to be kept, but it wasn't")
+	}
+	for i, test := range []struct {
+		compression int
+		evicted     bool
+	}{
+		{CompressTarXz, true}, // least recently used
+		{CompressZip, false},
+		{CompressNone, false}, // the binary itself
+	} {
+		b.mu.Lock()
+		a, ok := b.artifacts[test.compression]
+		b.mu.Unlock()
+		if test.evicted == ok {
+			t.Errorf("Test %d: Expected %s to be evicted: %v, got %v", i, formatName(test.compression), test.evicted, !ok)
+		}
+		if test.evicted {
+			if _, err := os.Stat(filepath.Join(dir, "caddy"+formatExt(test.compression))); !os.IsNotExist(err) {
+				t.Errorf("Test %d: Expected %s to be deleted, got %v", i, formatName(test.compression), err)
+			}
+		} else if _, err := os.Stat(a.File); err != nil {
+			t.Errorf("Test %d: Expected %s to be kept, got %v", i, formatName(test.compression), err)
+		}
+	}
+	if _, err := os.Stat(b.DownloadFile); err != nil {
+		t.Errorf("Expected the build's own download to be kept, got %v", err)
+	}
+}
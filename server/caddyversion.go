@@ -0,0 +1,59 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// CaddyVersions are the versions (tags) of Caddy that a build
+// can choose from. A build that doesn't choose one is made with
+// whatever Caddy the Builder has: the checkout in GOPATH, or the
+// version required by a ModuleBuilder. It must be set before
+// the first request.
+var CaddyVersions list
+
+// LoadCaddyVersions reads the list of Caddy versions that builds
+// can choose from, a JSON array of tags like ["v0.9.0", "v0.8.3"],
+// from the file at path and makes it CaddyVersions. The versions
+// must be semantic versions so that plugins' Caddy ranges can be
+// checked against them.
+func LoadCaddyVersions(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var versions list
+	err = json.Unmarshal(data, &versions)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, version := range versions {
+		if !features.IsSemver(version) {
+			return fmt.Errorf("%s: '%s' is not a semantic version", path, version)
+		}
+	}
+	CaddyVersions = versions
+	return nil
+}
+
+// checkCaddyVersion returns an error if caddyVersion is not one
+// of CaddyVersions, or if any of the plugins can't be built with
+// it. The empty version is always allowed.
+func checkCaddyVersion(caddyVersion string, plugins features.Plugins) error {
+	if caddyVersion == "" {
+		return nil
+	}
+	if !CaddyVersions.contains(caddyVersion) {
+		return errors.New("caddy version " + caddyVersion + " not supported")
+	}
+	for _, plugin := range plugins {
+		if !plugin.SupportsCaddy(caddyVersion) {
+			return errors.New("feature '" + plugin.Name + "' not supported with caddy " + caddyVersion)
+		}
+	}
+	return nil
+}
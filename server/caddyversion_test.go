@@ -0,0 +1,124 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// useCaddyVersions sets CaddyVersions for a test and
+// returns a function that restores them.
+func useCaddyVersions(versions ...string) func() {
+	old := CaddyVersions
+	CaddyVersions = versions
+	return func() {
+		CaddyVersions = old
+	}
+}
+
+func TestLoadCaddyVersions(t *testing.T) {
+	defer useCaddyVersions()()
+
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, test := range []struct {
+		contents  string
+		shouldErr bool
+	}{
+		{`["v0.9.0", "v0.8.3"]`, false},
+		{`[]`, false},
+		{`["master"]`, true},
+		{`{"versions": ["v0.9.0"]}`, true},
+	} {
+		path := filepath.Join(dir, "versions.json")
+		err := ioutil.WriteFile(path, []byte(test.contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = LoadCaddyVersions(path)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got %v", i, err)
+		}
+	}
+}
+
+func TestCheckCaddyVersion(t *testing.T) {
+	defer useCaddyVersions("v0.8.3", "v0.9.0")()
+
+	plugins := features.Plugins{{Name: "new", Caddy: ">=0.9"}, {Name: "any"}}
+	for i, test := range []struct {
+		version   string
+		plugins   features.Plugins
+		shouldErr bool
+	}{
+		{"", plugins, false},
+		{"v0.9.0", plugins, false},
+		{"v0.8.3", plugins[1:], false},
+		{"v0.8.3", plugins, true},
+		{"v0.10.0", plugins[1:], true},
+	} {
+		err := checkCaddyVersion(test.version, test.plugins)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, but got %v", i, err)
+		}
+	}
+}
+
+func TestBuildHandlerCaddyVersion(t *testing.T) {
+	defer useFakeBuilds(t)()
+	defer useCaddyVersions("v0.9.0")()
+
+	for i, test := range []struct {
+		query            string
+		expectedStatus   int
+		expectedFilename string
+	}{
+		{"?os=linux&arch=amd64", http.StatusOK, "caddy_linux_amd64_custom.tar.gz"},
+		{"?os=linux&arch=amd64&version=v0.9.0", http.StatusOK, "caddy_v0.9.0_linux_amd64_custom.tar.gz"},
+		{"?os=linux&arch=amd64&version=v0.8.3", http.StatusBadRequest, ""},
+	} {
+		req := httptest.NewRequest("GET", "/download/build"+test.query, nil)
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, req)
+
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d: %s", i, test.expectedStatus, rec.Code, rec.Body.String())
+			continue
+		}
+		if test.expectedFilename == "" {
+			continue
+		}
+		if disposition := rec.Header().Get("Content-Disposition"); !strings.Contains(disposition, `"`+test.expectedFilename+`"`) {
+			t.Errorf("Test %d: Expected download filename %s, got '%s'", i, test.expectedFilename, disposition)
+		}
+	}
+
+	buildsMutex.Lock()
+	var hashes []string
+	for hash := range builds {
+		hashes = append(hashes, hash)
+	}
+	buildsMutex.Unlock()
+	if len(hashes) != 2 {
+		t.Errorf("Expected 2 builds, got %d: %v", len(hashes), hashes)
+	}
+	for _, hash := range hashes {
+		deleteBuildJob(hash)
+	}
+}
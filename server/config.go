@@ -0,0 +1,484 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOrigins are the origins that browsers may call the
+// build server from; "*" allows any origin.
+var CORSOrigins = []string{"*"}
+
+// setCORS sets the CORS headers of the response to r.
+func setCORS(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range CORSOrigins {
+		if allowed == "*" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			return
+		}
+		if origin != "" && strings.EqualFold(origin, allowed) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			break
+		}
+	}
+	w.Header().Add("Vary", "Origin")
+}
+
+// preflight answers r if it's an OPTIONS request, like the
+// preflight request browsers send before calling the build
+// server from another origin, and returns whether it did.
+// Such requests may use methods and the headers clients of
+// the build server send.
+func preflight(w http.ResponseWriter, r *http.Request, methods string) bool {
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	w.Header().Set("Allow", methods)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Prefer")
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// Config is the configuration of the build server. It is read
+// from a JSON file, then overridden by environment variables and
+// then by command line flags; see LoadConfig.
+type Config struct {
+	// Listen is the address to serve HTTP on, like ":5050".
+	Listen string `json:"listen"`
+
+	// TLSCert and TLSKey are the certificate and key files
+	// to serve HTTPS with. If not set, HTTP is served. The
+	// files are reloaded when they change.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
+
+	// RedirectListen is an address to serve HTTP on that
+	// redirects to HTTPS, like ":80". It needs TLS.
+	RedirectListen string `json:"redirect_listen,omitempty"`
+
+	// BuildPath is where builds are stored; see BuildPath.
+	BuildPath string `json:"build_path"`
+
+	// BuildExpiry is how long finished builds are kept, like
+	// "72h"; see BuildExpiry. Empty or "0" means forever.
+	BuildExpiry Duration `json:"build_expiry,omitempty"`
+
+	// CacheQuota is the most bytes of builds kept on disk;
+	// see CacheQuota. 0 means no limit.
+	CacheQuota int64 `json:"cache_quota,omitempty"`
+
+	// Workers is how many builds may run at once, and QueueSize
+	// how many may wait for a worker; see Workers and QueueSize.
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
+
+	// CORSOrigins are the origins browsers may call the build
+	// server from, like "https://caddyserver.com"; see CORSOrigins.
+	CORSOrigins []string `json:"cors_origins"`
+
+	// Registry is the plugin registry file. If empty, the
+	// built-in registry is used.
+	Registry string `json:"registry,omitempty"`
+
+	// Platforms configures the platforms that builds can be
+	// made for; see LoadPlatforms. If empty, the built-in
+	// platforms are used.
+	Platforms string `json:"platforms,omitempty"`
+
+	// Versions lists the Caddy versions that builds can choose
+	// from; see LoadCaddyVersions. If empty, builds can't
+	// choose a version.
+	Versions string `json:"versions,omitempty"`
+
+	// Modules configures building with Go modules instead of
+	// GOPATH; see LoadModuleBuilder. If empty, GOPATH is used.
+	Modules string `json:"modules,omitempty"`
+
+	// SigningKey is the key to sign builds with; see
+	// LoadSigningKey. If empty, builds aren't signed.
+	SigningKey string `json:"signing_key,omitempty"`
+
+	// LogFile is the file to log to, LogFormat is "logfmt" or
+	// "json" and LogLevel is the least severe level logged.
+	LogFile   string `json:"log_file"`
+	LogFormat string `json:"log_format"`
+	LogLevel  string `json:"log_level"`
+
+	// LogMaxSize is the most bytes and LogMaxAge the longest
+	// time the log file is written to before it's rotated, and
+	// LogMaxBackups is how many rotated files are kept; see
+	// LogFile. 0 means no limit.
+	LogMaxSize    int64    `json:"log_max_size"`
+	LogMaxAge     Duration `json:"log_max_age"`
+	LogMaxBackups int      `json:"log_max_backups"`
+
+	// ShutdownTimeout is how long to wait for running builds and
+	// downloads when shutting down.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// DefaultConfig returns the configuration that is used for
+// the settings that aren't configured.
+func DefaultConfig() Config {
+	_, logFormat, logLevel := logSettings()
+	return Config{
+		Listen:          ":5050",
+		BuildPath:       BuildPath,
+		BuildExpiry:     Duration{BuildExpiry},
+		CacheQuota:      CacheQuota,
+		Workers:         Workers,
+		QueueSize:       QueueSize,
+		CORSOrigins:     append([]string(nil), CORSOrigins...),
+		LogFile:         "builds.log",
+		LogFormat:       logFormat,
+		LogLevel:        logLevel.String(),
+		LogMaxSize:      100 << 20,
+		LogMaxAge:       Duration{7 * 24 * time.Hour},
+		LogMaxBackups:   10,
+		ShutdownTimeout: Duration{5 * time.Minute},
+	}
+}
+
+// Duration is a time.Duration that is written as a string,
+// like "1h30m", in JSON.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("durations must be strings like \"72h\"")
+	}
+	return d.set(s)
+}
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) set(s string) error {
+	if s == "" || s == "0" {
+		d.Duration = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// configSetting is a setting that can be overridden by
+// an environment variable and a command line flag.
+type configSetting struct {
+	name  string // of the flag; the variable is EnvPrefix + NAME
+	usage string
+	set   func(c *Config, v string) error
+}
+
+// EnvPrefix is the prefix of the environment variables
+// that override configuration settings.
+const EnvPrefix = "BUILDSRV_"
+
+var configSettings = []configSetting{
+	{"listen", "address to listen on", func(c *Config, v string) error {
+		c.Listen = v
+		return nil
+	}},
+	{"tls-cert", "certificate file to serve HTTPS with", func(c *Config, v string) error {
+		c.TLSCert = v
+		return nil
+	}},
+	{"tls-key", "key file to serve HTTPS with", func(c *Config, v string) error {
+		c.TLSKey = v
+		return nil
+	}},
+	{"redirect-listen", "address to redirect HTTP to HTTPS from", func(c *Config, v string) error {
+		c.RedirectListen = v
+		return nil
+	}},
+	{"build-path", "directory to store builds in", func(c *Config, v string) error {
+		c.BuildPath = v
+		return nil
+	}},
+	{"build-expiry", "how long to keep builds, like 72h; 0 is forever", func(c *Config, v string) error {
+		return c.BuildExpiry.set(v)
+	}},
+	{"cache-quota", "most bytes of builds to keep; 0 is no limit", func(c *Config, v string) (err error) {
+		c.CacheQuota, err = strconv.ParseInt(v, 10, 64)
+		return
+	}},
+	{"workers", "how many builds may run at once", func(c *Config, v string) (err error) {
+		c.Workers, err = strconv.Atoi(v)
+		return
+	}},
+	{"queue-size", "how many builds may wait for a worker", func(c *Config, v string) (err error) {
+		c.QueueSize, err = strconv.Atoi(v)
+		return
+	}},
+	{"cors-origins", "comma-separated origins that may call the API; * is any", func(c *Config, v string) error {
+		c.CORSOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.CORSOrigins = append(c.CORSOrigins, origin)
+			}
+		}
+		return nil
+	}},
+	{"registry", "plugin registry file", func(c *Config, v string) error {
+		c.Registry = v
+		return nil
+	}},
+	{"platforms", "platforms configuration file", func(c *Config, v string) error {
+		c.Platforms = v
+		return nil
+	}},
+	{"versions", "Caddy versions file", func(c *Config, v string) error {
+		c.Versions = v
+		return nil
+	}},
+	{"modules", "Go modules configuration file, to build with modules", func(c *Config, v string) error {
+		c.Modules = v
+		return nil
+	}},
+	{"signing-key", "key file to sign builds with", func(c *Config, v string) error {
+		c.SigningKey = v
+		return nil
+	}},
+	{"log-file", "file to log to", func(c *Config, v string) error {
+		c.LogFile = v
+		return nil
+	}},
+	{"log-format", "logfmt or json", func(c *Config, v string) error {
+		c.LogFormat = v
+		return nil
+	}},
+	{"log-level", "debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"log-max-size", "most bytes to write to the log file before rotating it; 0 is no limit", func(c *Config, v string) (err error) {
+		c.LogMaxSize, err = strconv.ParseInt(v, 10, 64)
+		return
+	}},
+	{"log-max-age", "longest to write to the log file before rotating it, like 168h; 0 is no limit", func(c *Config, v string) error {
+		return c.LogMaxAge.set(v)
+	}},
+	{"log-max-backups", "how many rotated log files to keep; 0 is all", func(c *Config, v string) (err error) {
+		c.LogMaxBackups, err = strconv.Atoi(v)
+		return
+	}},
+	{"shutdown-timeout", "how long to wait for builds and downloads when shutting down", func(c *Config, v string) error {
+		return c.ShutdownTimeout.set(v)
+	}},
+}
+
+// envName returns the environment variable of the setting.
+func (s configSetting) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+// configFlag is the flag.Value of a setting; flags are
+// applied after the file and environment are read.
+type configFlag struct {
+	value *string
+}
+
+func (f configFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return *f.value
+}
+
+func (f configFlag) Set(v string) error {
+	*f.value = v
+	return nil
+}
+
+// ConfigFlags defines a flag on fs for each setting that can
+// override the configuration, and returns a function that reads
+// the configuration file at path (if it exists, or if it is
+// required), applies the environment variables and flags that
+// are set, and validates the result. Call it after fs is parsed.
+func ConfigFlags(fs *flag.FlagSet) func(path string, required bool) (Config, error) {
+	values := make(map[string]*string)
+	for _, s := range configSettings {
+		v := new(string)
+		fs.Var(configFlag{v}, s.name, s.usage+" (env "+s.envName()+")")
+		values[s.name] = v
+	}
+	return func(path string, required bool) (Config, error) {
+		flags := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			if v, ok := values[f.Name]; ok {
+				flags[f.Name] = *v
+			}
+		})
+		return LoadConfig(path, required, os.LookupEnv, flags)
+	}
+}
+
+// LoadConfig returns the default configuration, overridden by
+// the file at path, then by the environment variables that
+// lookupEnv finds, then by flags (by name). The file is optional
+// unless required, and may only have the keys of Config. The
+// configuration is validated; all of the problems with it are
+// reported in the error.
+func LoadConfig(path string, required bool, lookupEnv func(string) (string, bool), flags map[string]string) (Config, error) {
+	c := DefaultConfig()
+	if path != "" {
+		f, err := os.Open(path)
+		if err == nil {
+			dec := json.NewDecoder(f)
+			dec.DisallowUnknownFields()
+			err = dec.Decode(&c)
+			f.Close()
+			if err != nil {
+				return c, fmt.Errorf("%s: %v", path, err)
+			}
+		} else if required || !os.IsNotExist(err) {
+			return c, err
+		}
+	}
+
+	var problems []string
+	for _, s := range configSettings {
+		if v, ok := lookupEnv(s.envName()); ok {
+			if err := s.set(&c, v); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", s.envName(), err))
+			}
+		}
+	}
+	for _, s := range configSettings {
+		if v, ok := flags[s.name]; ok {
+			if err := s.set(&c, v); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v", s.name, err))
+			}
+		}
+	}
+	problems = append(problems, c.problems()...)
+	if len(problems) > 0 {
+		return c, errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return c, nil
+}
+
+// problems returns what is wrong with c, if anything.
+func (c Config) problems() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		add("listen: %v", err)
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		add("listen: bad port '%s'", port)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		add("tls_cert and tls_key: both or neither must be set")
+	}
+	if c.RedirectListen != "" {
+		if c.TLSCert == "" {
+			add("redirect_listen: needs tls_cert and tls_key")
+		}
+		if _, _, err := net.SplitHostPort(c.RedirectListen); err != nil {
+			add("redirect_listen: %v", err)
+		} else if c.RedirectListen == c.Listen {
+			add("redirect_listen: must not be the same as listen")
+		}
+	}
+	for _, file := range []struct{ name, path string }{
+		{"tls_cert", c.TLSCert},
+		{"tls_key", c.TLSKey},
+		{"registry", c.Registry},
+		{"platforms", c.Platforms},
+		{"versions", c.Versions},
+		{"modules", c.Modules},
+		{"signing_key", c.SigningKey},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			add("%s: %v", file.name, err)
+		}
+	}
+	if c.BuildPath == "" {
+		add("build_path: must be set")
+	} else if info, err := os.Stat(c.BuildPath); err == nil && !info.IsDir() {
+		add("build_path: %s is not a directory", c.BuildPath)
+	}
+	if c.BuildExpiry.Duration < 0 {
+		add("build_expiry: must not be negative")
+	}
+	if c.CacheQuota < 0 {
+		add("cache_quota: must not be negative")
+	}
+	if c.Workers < 1 {
+		add("workers: must be at least 1")
+	}
+	if c.QueueSize < 1 {
+		add("queue_size: must be at least 1")
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			add("cors_origins: '%s' is not * or an origin like https://example.com", origin)
+		}
+	}
+	if c.LogFile == "" {
+		add("log_file: must be set")
+	}
+	if c.LogFormat != "logfmt" && c.LogFormat != "json" {
+		add("log_format: must be logfmt or json, not '%s'", c.LogFormat)
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		add("log_level: %v", err)
+	}
+	if c.LogMaxSize < 0 {
+		add("log_max_size: must not be negative")
+	}
+	if c.LogMaxAge.Duration < 0 {
+		add("log_max_age: must not be negative")
+	}
+	if c.LogMaxBackups < 0 {
+		add("log_max_backups: must not be negative")
+	}
+	if c.ShutdownTimeout.Duration < 0 {
+		add("shutdown_timeout: must not be negative")
+	}
+	return problems
+}
+
+// Apply sets the package settings from c, which must be valid.
+// The settings that only main uses, like Listen, are left alone.
+func (c Config) Apply() {
+	BuildPath = c.BuildPath
+	BuildExpiry = c.BuildExpiry.Duration
+	CacheQuota = c.CacheQuota
+	Workers = c.Workers
+	QueueSize = c.QueueSize
+	CORSOrigins = c.CORSOrigins
+	level, _ := ParseLevel(c.LogLevel)
+	setLogFormat(c.LogFormat, level)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "buildsrv.json")
+	ioutil.WriteFile(path, []byte(`{"listen": ":8080", "workers": 4, "build_expiry": "72h", "cors_origins": ["https://caddyserver.com"]}`), 0644)
+
+	env := map[string]string{
+		"BUILDSRV_WORKERS":     "6",
+		"BUILDSRV_LOG_FORMAT":  "json",
+		"BUILDSRV_LOG_MAX_AGE": "24h",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	c, err := LoadConfig(path, true, lookupEnv, map[string]string{"workers": "8", "build-path": dir})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	for i, test := range []struct {
+		actual, expected interface{}
+	}{
+		{c.Listen, ":8080"},                                  // file
+		{c.BuildExpiry.Duration, 72 * time.Hour},             // file
+		{c.CORSOrigins, []string{"https://caddyserver.com"}}, // file
+		{c.LogFormat, "json"},                                // env over default
+		{c.Workers, 8},                                       // flag over env over file
+		{c.BuildPath, dir},                                   // flag
+		{c.QueueSize, QueueSize},                             // default
+		{c.LogMaxAge.Duration, 24 * time.Hour},               // env over default
+		{c.LogMaxSize, int64(100 << 20)},                     // default
+		{c.LogMaxBackups, 10},                                // default
+	} {
+		if !reflect.DeepEqual(test.actual, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, test.actual)
+		}
+	}
+
+	// the file is optional unless required
+	if _, err := LoadConfig(filepath.Join(dir, "nope.json"), false, lookupEnv, nil); err != nil {
+		t.Errorf("Expected missing optional file to be fine, got %v", err)
+	}
+	if _, err := LoadConfig(filepath.Join(dir, "nope.json"), true, lookupEnv, nil); err == nil {
+		t.Error("Expected error for missing required file, but didn't get one")
+	}
+
+	// misspelled settings aren't ignored
+	ioutil.WriteFile(path, []byte(`{"listen": ":8080", "worker": 4}`), 0644)
+	_, err = LoadConfig(path, true, lookupEnv, nil)
+	if err == nil || !strings.Contains(err.Error(), `"worker"`) {
+		t.Errorf("Expected error about unknown key \"worker\", got %v", err)
+	}
+}
+
+func TestConfigProblems(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	for i, test := range []struct {
+		flags    map[string]string
+		expected []string
+	}{
+		{map[string]string{}, nil},
+		{map[string]string{"listen": "localhost"}, []string{"listen:"}},
+		{map[string]string{"listen": ":99999"}, []string{"listen: bad port"}},
+		{map[string]string{"tls-cert": "cert.pem"}, []string{"tls_cert and tls_key", "tls_cert:"}},
+		{map[string]string{"redirect-listen": ":80"}, []string{"redirect_listen: needs"}},
+		{map[string]string{"redirect-listen": ":5050"}, []string{"redirect_listen: must not be"}},
+		{map[string]string{"workers": "0", "queue-size": "-1"}, []string{"workers:", "queue_size:"}},
+		{map[string]string{"queue-size": "0"}, []string{"queue_size:"}},
+		{map[string]string{"modules": "nope.json", "signing-key": "nope.key"}, []string{"modules:", "signing_key:"}},
+		{map[string]string{"workers": "many"}, []string{"-workers:"}},
+		{map[string]string{"build-expiry": "-1h"}, []string{"build_expiry:"}},
+		{map[string]string{"cors-origins": "*, https://example.com"}, nil},
+		{map[string]string{"cors-origins": "example.com,https://example.com/path"}, []string{"'example.com'", "'https://example.com/path'"}},
+		{map[string]string{"registry": "/no/such/registry.json"}, []string{"registry:"}},
+		{map[string]string{"log-format": "xml", "log-level": "loud"}, []string{"log_format:", "log_level:"}},
+		{map[string]string{"log-max-size": "0", "log-max-age": "0", "log-max-backups": "0"}, nil},
+		{map[string]string{"log-max-size": "-1", "log-max-age": "-1h", "log-max-backups": "-1"}, []string{"log_max_size:", "log_max_age:", "log_max_backups:"}},
+	} {
+		_, err := LoadConfig("", false, noEnv, test.flags)
+		if len(test.expected) == 0 {
+			if err != nil {
+				t.Errorf("Test %d: Expected no error, got %v", i, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Test %d: Expected error, but didn't get one", i)
+			continue
+		}
+		for _, problem := range test.expected {
+			if !strings.Contains(err.Error(), problem) {
+				t.Errorf("Test %d: Expected '%s' in error, got %v", i, problem, err)
+			}
+		}
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("buildsrv", flag.ContinueOnError)
+	load := ConfigFlags(fs)
+	err := fs.Parse([]string{"-listen", ":9090", "-cors-origins", "https://a.example,https://b.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := load("", false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if c.Listen != ":9090" {
+		t.Errorf("Expected listen address from flag, got %s", c.Listen)
+	}
+	if expected := []string{"https://a.example", "https://b.example"}; !reflect.DeepEqual(c.CORSOrigins, expected) {
+		t.Errorf("Expected CORS origins %v, got %v", expected, c.CORSOrigins)
+	}
+}
+
+func TestSetCORS(t *testing.T) {
+	oldOrigins := CORSOrigins
+	defer func() { CORSOrigins = oldOrigins }()
+
+	for i, test := range []struct {
+		allowed  []string
+		origin   string
+		expected string
+	}{
+		{[]string{"*"}, "https://example.com", "*"},
+		{[]string{"https://caddyserver.com"}, "https://caddyserver.com", "https://caddyserver.com"},
+		{[]string{"https://caddyserver.com"}, "https://example.com", ""},
+		{[]string{"https://caddyserver.com"}, "", ""},
+	} {
+		CORSOrigins = test.allowed
+		req := httptest.NewRequest("GET", "/features.json", nil)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		rec := httptest.NewRecorder()
+		setCORS(rec, req)
+		if actual := rec.Header().Get("Access-Control-Allow-Origin"); actual != test.expected {
+			t.Errorf("Test %d: Expected allowed origin '%s', got '%s'", i, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// writeDeb writes a Debian package of b to dest.
+func (b *Build) writeDeb(dest string) error {
+	arch, err := packageArch(debArch, b.GoOS, b.GoArch, b.GoARM)
+	if err != nil {
+		return err
+	}
+	files, err := b.packageFiles("/lib/systemd/system")
+	if err != nil {
+		return err
+	}
+	mtime := b.Created
+
+	var installedSize int64
+	var md5sums, conffiles bytes.Buffer
+	for _, f := range files {
+		installedSize += int64(len(f.Data))
+		fmt.Fprintf(&md5sums, "%x  %s\n", md5.Sum(f.Data), strings.TrimPrefix(f.Path, "/"))
+		if f.Conf {
+			fmt.Fprintf(&conffiles, "%s\n", f.Path)
+		}
+	}
+
+	var control bytes.Buffer
+	fmt.Fprintf(&control, "Package: %s\n", pkgName)
+	fmt.Fprintf(&control, "Version: %s\n", b.packageVersion())
+	fmt.Fprintf(&control, "Architecture: %s\n", arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", PackageMaintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (installedSize+1023)/1024)
+	fmt.Fprintf(&control, "Section: web\n")
+	fmt.Fprintf(&control, "Priority: optional\n")
+	fmt.Fprintf(&control, "Homepage: https://caddyserver.com\n")
+	fmt.Fprintf(&control, "Description: Caddy web server (custom build)\n")
+	for _, line := range strings.Split(b.packageDescription(), "\n") {
+		if line == "" {
+			line = "."
+		}
+		fmt.Fprintf(&control, " %s\n", line)
+	}
+
+	controlTar, err := debTarGz(mtime, []pkgFile{
+		{Path: "/conffiles", Mode: 0644, Data: conffiles.Bytes()},
+		{Path: "/control", Mode: 0644, Data: control.Bytes()},
+		{Path: "/md5sums", Mode: 0644, Data: md5sums.Bytes()},
+	})
+	if err != nil {
+		return err
+	}
+	dataTar, err := debTarGz(mtime, files)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.WriteString(out, "!<arch>\n")
+	if err != nil {
+		return err
+	}
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		err = writeArMember(out, member.name, mtime, member.data)
+		if err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// writeArMember writes a file to an ar archive, as read by dpkg.
+func writeArMember(w io.Writer, name string, mtime time.Time, data []byte) error {
+	_, err := fmt.Fprintf(w, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, mtime.Unix(), 0, 0, 0100644, len(data))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+	if len(data)%2 == 1 {
+		_, err = w.Write([]byte{'\n'})
+	}
+	return err
+}
+
+// debTarGz returns a gzipped tarball of files, owned by root
+// and relative to the current directory, as in Debian packages.
+// The directories that contain the files are added as well.
+func debTarGz(mtime time.Time, files []pkgFile) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	dirs := map[string]bool{"/": true}
+	writeHeader := func(name string, mode os.FileMode, size int, typeflag byte) error {
+		return tw.WriteHeader(&tar.Header{
+			Name:     "." + name,
+			Mode:     int64(mode.Perm()),
+			Size:     int64(size),
+			ModTime:  mtime,
+			Typeflag: typeflag,
+			Uname:    "root",
+			Gname:    "root",
+			Format:   tar.FormatGNU,
+		})
+	}
+	err := writeHeader("/", 0755, 0, tar.TypeDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		// parent directories come first
+		var parents []string
+		for dir := path.Dir(f.Path); !dirs[dir]; dir = path.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+			dirs[dir] = true
+		}
+		for _, dir := range parents {
+			err = writeHeader(dir+"/", 0755, 0, tar.TypeDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = writeHeader(f.Path, f.Mode, len(f.Data), tar.TypeReg)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tw.Write(f.Data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// FeaturesHandler responds with the list of registered plugins as
+// JSON. If the os and arch query parameters are given, only the
+// plugins that can be built for that platform are listed. Likewise,
+// if the version parameter is given, only the plugins that can be
+// built with that version of Caddy are listed.
+func FeaturesHandler(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r)
+
+	goOS := r.URL.Query().Get("os")
+	goArch := r.URL.Query().Get("arch")
+
+	registry := features.Current()
+	if goOS != "" || goArch != "" {
+		if goOS == "" || goArch == "" {
+			handleError(w, r, errors.New("os and arch must be given together"), http.StatusBadRequest)
+			return
+		}
+		if !allowed.valid(goOS, goArch) {
+			handleError(w, r, errors.New(goOS+"/"+goArch+" not supported"), http.StatusBadRequest)
+			return
+		}
+		registry = registry.ForPlatform(goOS, goArch)
+	}
+	if caddyVersion := r.URL.Query().Get("version"); caddyVersion != "" {
+		if !CaddyVersions.contains(caddyVersion) {
+			handleError(w, r, errors.New("caddy version "+caddyVersion+" not supported"), http.StatusBadRequest)
+			return
+		}
+		registry = registry.ForCaddy(caddyVersion)
+	}
+
+	var plugins features.Plugins
+	for _, plugin := range registry {
+		if plugin.Name != "" {
+			plugins = append(plugins, plugin)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plugins)
+}
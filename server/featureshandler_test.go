@@ -0,0 +1,43 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+func TestFeaturesHandler(t *testing.T) {
+	for i, test := range []struct {
+		query          string
+		expectedStatus int
+	}{
+		{"", http.StatusOK},
+		{"?os=linux&arch=amd64", http.StatusOK},
+		{"?os=linux", http.StatusBadRequest},
+		{"?arch=amd64", http.StatusBadRequest},
+		{"?os=bad_os&arch=amd64", http.StatusBadRequest},
+		{"?version=v0.8.3", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("GET", "/features.json"+test.query, nil)
+		rec := httptest.NewRecorder()
+		FeaturesHandler(rec, req)
+
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectedStatus, rec.Code)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		var plugins features.Plugins
+		if err := json.NewDecoder(rec.Body).Decode(&plugins); err != nil {
+			t.Errorf("Test %d: Expected valid JSON, got error: %v", i, err)
+		}
+		if !plugins.Contains("HTTP") {
+			t.Errorf("Test %d: Expected HTTP plugin in list, but it wasn't", i)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mholt/archiver"
+	"github.com/ulikunitz/xz"
+)
+
+// The formats that builds can be downloaded in. The values
+// are stored in manifests, so new ones go at the end.
+const (
+	CompressZip = iota
+	CompressTarGz
+	CompressTarXz
+	CompressTarZst
+	CompressNone // the binary by itself
+	CompressDeb  // Debian package, for linux only
+	CompressRPM  // RPM package, for linux only
+	CompressOCI  // OCI image layout tarball, for static linux builds
+)
+
+// formats maps the names of formats, as given by clients
+// and in platform configuration, to their constants.
+var formats = map[string]int{
+	"zip":     CompressZip,
+	"tar.gz":  CompressTarGz,
+	"tar.xz":  CompressTarXz,
+	"tar.zst": CompressTarZst,
+	"binary":  CompressNone,
+	"deb":     CompressDeb,
+	"rpm":     CompressRPM,
+	"oci":     CompressOCI,
+}
+
+// isArchive returns whether compression is an archive of
+// the build or the bare binary, which can be made for any
+// platform, rather than a Linux package or image.
+func isArchive(compression int) bool {
+	switch compression {
+	case CompressDeb, CompressRPM, CompressOCI:
+		return false
+	}
+	return true
+}
+
+// formatName returns the name of the format compression.
+func formatName(compression int) string {
+	for name, c := range formats {
+		if c == compression {
+			return name
+		}
+	}
+	return fmt.Sprint(compression)
+}
+
+// checkFormat returns the compression constant of the format
+// with the given name, or an error if there is no such format
+// or if builds for the platform can't be made in it.
+func checkFormat(format, goOS, goArch, goARM string) (int, error) {
+	compression, ok := formats[format]
+	if !ok {
+		return 0, errors.New("format '" + format + "' not supported")
+	}
+	var err error
+	switch compression {
+	case CompressDeb:
+		_, err = packageArch(debArch, goOS, goArch, goARM)
+	case CompressRPM:
+		_, err = packageArch(rpmArch, goOS, goArch, goARM)
+	case CompressOCI:
+		err = checkImagePlatform(goOS, goArch)
+	}
+	return compression, err
+}
+
+// artifact is a file that a build can be downloaded as. All
+// artifacts of a build are made from the same compiled binary.
+// Builds are cached in two tiers: the binary, which is costly to
+// compile, and the artifacts packaged from it, which are cheap to
+// make again and so are evicted first.
+type artifact struct {
+	File          string
+	Filename      string // name to download File as
+	Compression   int
+	Checksum      string // hex-encoded SHA-256 of File
+	SignatureFile string // empty if builds aren't signed
+
+	size       int64     // of File and the files that go with it
+	lastAccess time.Time // when it was last asked for
+}
+
+// artifact returns the download of b in the given format. The
+// download in b's own format is made by the build job; the
+// others are packaged from the binary the first time they are
+// asked for, and kept with the build from then on. b must
+// have succeeded.
+func (b *Build) artifact(compression int) (artifact, error) {
+	if compression == b.DownloadFileCompression {
+		return artifact{
+			File:          b.DownloadFile,
+			Filename:      b.DownloadFilename,
+			Compression:   b.DownloadFileCompression,
+			Checksum:      b.Checksum,
+			SignatureFile: b.SignatureFile,
+		}, nil
+	}
+
+	b.packMu.Lock()
+	defer b.packMu.Unlock()
+
+	b.mu.Lock()
+	a, ok := b.artifacts[compression]
+	if ok {
+		a.lastAccess = time.Now()
+		b.artifacts[compression] = a
+	}
+	b.mu.Unlock()
+	if ok {
+		return a, nil
+	}
+	if b.OutputFile == "" {
+		return a, errors.New("build " + b.Hash + " has no binary to make other formats from")
+	}
+
+	a, err := b.pack(compression)
+	if err != nil {
+		return a, err
+	}
+	a.lastAccess = time.Now()
+
+	b.mu.Lock()
+	if b.artifacts == nil {
+		b.artifacts = make(map[int]artifact)
+	}
+	b.artifacts[compression] = a
+	b.mu.Unlock()
+
+	err = b.saveManifest()
+	if err != nil {
+		return a, err
+	}
+	b.updateSize()
+	evictBuilds(b)
+	return a, nil
+}
+
+// pack packages the binary of b in the given format, next to
+// it, and computes the checksum and signature of the result.
+// The raw binary is not copied; it is its own artifact.
+func (b *Build) pack(compression int) (artifact, error) {
+	start := time.Now()
+	name := strings.TrimSuffix(b.DownloadFilename, formatExt(b.DownloadFileCompression))
+	if b.DownloadFileCompression == CompressNone {
+		name = strings.TrimSuffix(name, b.platform.Exe)
+	}
+	a := artifact{
+		File:        filepath.Join(filepath.Dir(b.DownloadFile), name+formatExt(compression)),
+		Filename:    name + formatExt(compression),
+		Compression: compression,
+	}
+	if compression == CompressNone {
+		a.File = b.OutputFile
+		a.Filename += b.platform.Exe
+	} else {
+		err := b.packInto(compression, a.File, nil)
+		if err != nil {
+			return a, err
+		}
+	}
+
+	var err error
+	a.Checksum, err = checksumFile(a.File)
+	if err != nil {
+		return a, err
+	}
+	a.SignatureFile, err = signFile(a.File)
+	if err != nil {
+		return a, fmt.Errorf("error signing: %v", err)
+	}
+	a.size = a.diskSize()
+	logInfo("packaged build", append(b.logFields(), "format", formatName(compression), "duration", time.Since(start))...)
+	return a, nil
+}
+
+// files returns the files of a on disk.
+func (a artifact) files() []string {
+	files := []string{a.File, a.File + ".sha256"}
+	if a.SignatureFile != "" {
+		files = append(files, a.SignatureFile)
+	}
+	return files
+}
+
+// diskSize returns the total size of the files of a.
+func (a artifact) diskSize() int64 {
+	var size int64
+	for _, file := range a.files() {
+		if info, err := os.Stat(file); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// dropArtifact deletes the artifact of b in the format
+// compression, if it was packaged from the binary, and
+// returns how much space that freed. It can be made again
+// the next time it is asked for.
+func (b *Build) dropArtifact(compression int) int64 {
+	b.mu.Lock()
+	a, ok := b.artifacts[compression]
+	if !ok || a.File == b.OutputFile {
+		b.mu.Unlock()
+		return 0
+	}
+	delete(b.artifacts, compression)
+	// files are removed while b.mu is held so that the artifact
+	// isn't packaged again before its old files are gone
+	for _, file := range a.files() {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			logError("deleting artifact", "hash", b.Hash, "error", err)
+		}
+	}
+	b.mu.Unlock()
+
+	err := b.saveManifest()
+	if err != nil {
+		logError("saving manifest", "hash", b.Hash, "error", err)
+	}
+	b.updateSize()
+	return a.size
+}
+
+// packInto packages b in the format compression into
+// dest, noting what it does in output, which may be nil.
+func (b *Build) packInto(compression int, dest string, output *buildLog) error {
+	switch compression {
+	case CompressDeb:
+		output.Printf("Making Debian package %s", dest)
+		return b.writeDeb(dest)
+	case CompressRPM:
+		output.Printf("Making RPM package %s", dest)
+		return b.writeRPM(dest)
+	case CompressOCI:
+		output.Printf("Making container image %s", dest)
+		return b.writeImage(dest)
+	}
+	output.Printf("Compressing into %s", dest)
+	err := archive(compression, dest, b.distFiles(output))
+	if err != nil {
+		return fmt.Errorf("error compressing: %v", err)
+	}
+	return nil
+}
+
+// distFiles returns the files that go into the archives of b:
+// the distribution files of Caddy that exist, the build info
+// and the binary. The distribution files that are left out
+// are noted in output, which may be nil.
+func (b *Build) distFiles(output *buildLog) []string {
+	var fileList []string
+	for _, distFile := range []string{
+		filepath.Join(CaddyPath, "/dist/README.txt"),
+		filepath.Join(CaddyPath, "/dist/LICENSES.txt"),
+		filepath.Join(CaddyPath, "/dist/CHANGES.txt"),
+		filepath.Join(CaddyPath, "/dist/init"),
+	} {
+		if _, err := os.Stat(distFile); err != nil {
+			output.Printf("Leaving out %s: %v", filepath.Base(distFile), err)
+			continue
+		}
+		fileList = append(fileList, distFile)
+	}
+	buildInfoFile := filepath.Join(filepath.Dir(b.OutputFile), buildInfoFilename)
+	return append(fileList, buildInfoFile, b.OutputFile)
+}
+
+// artifactByFile returns the artifact of b whose file is at path.
+func (b *Build) artifactByFile(path string) (artifact, bool) {
+	if path == b.DownloadFile {
+		a, err := b.artifact(b.DownloadFileCompression)
+		return a, err == nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, a := range b.artifacts {
+		if a.File == path {
+			return a, true
+		}
+	}
+	return artifact{}, false
+}
+
+// formatExt returns the file extension of the format compression.
+func formatExt(compression int) string {
+	switch compression {
+	case CompressNone:
+		return ""
+	case CompressOCI:
+		return ".oci.tar"
+	}
+	return "." + formatName(compression)
+}
+
+// archive writes the files (and directories) in fileList
+// into a new archive at dest in the format compression.
+func archive(compression int, dest string, fileList []string) error {
+	switch compression {
+	case CompressZip:
+		return archiver.Zip(dest, fileList)
+	case CompressTarGz:
+		return archiver.TarGz(dest, fileList)
+	case CompressTarXz:
+		return writeTar(dest, fileList, func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		})
+	case CompressTarZst:
+		return writeTar(dest, fileList, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		})
+	}
+	return fmt.Errorf("unknown compress type %v", compression)
+}
+
+// writeTar writes the files in fileList into a tarball at dest
+// that is compressed by the writer that compressor returns. Each
+// file is put at the top level; directories are added with their
+// contents.
+func writeTar(dest string, fileList []string, compressor func(io.Writer) (io.WriteCloser, error)) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cw, err := compressor(out)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(cw)
+
+	for _, file := range fileList {
+		base := filepath.Dir(file)
+		err = filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return addToTar(tw, base, path, info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	err = cw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// addToTar writes the file at path with the given info to tw,
+// named relative to base.
+func addToTar(tw *tar.Writer, base, path string, info os.FileInfo) error {
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil // no links and such in downloads
+	}
+	name, err := filepath.Rel(base, path)
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	err = tw.WriteHeader(hdr)
+	if err != nil || info.IsDir() {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestArchiveTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "init", "linux"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "init", "linux", "caddy.service"), []byte("[Unit]"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "caddy"), []byte("binary"), 0755)
+	fileList := []string{filepath.Join(dir, "init"), filepath.Join(dir, "caddy")}
+
+	for i, test := range []struct {
+		compression  int
+		decompressor func(io.Reader) (io.Reader, error)
+	}{
+		{CompressTarXz, func(r io.Reader) (io.Reader, error) {
+			return xz.NewReader(r)
+		}},
+		{CompressTarZst, func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		}},
+	} {
+		dest := filepath.Join(dir, "caddy"+formatExt(test.compression))
+		err := archive(test.compression, dest, fileList)
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+			continue
+		}
+
+		f, err := os.Open(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := test.decompressor(f)
+		if err != nil {
+			f.Close()
+			t.Errorf("Test %d: Expected archive to decompress, got %v", i, err)
+			continue
+		}
+		var names []string
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("Test %d: Expected valid tarball, got %v", i, err)
+				break
+			}
+			names = append(names, hdr.Name)
+			if hdr.Name == "caddy" && hdr.Mode&0100 == 0 {
+				t.Errorf("Test %d: Expected binary to stay executable, got mode %o", i, hdr.Mode)
+			}
+		}
+		f.Close()
+
+		expected := []string{"init/", "init/linux/", "init/linux/caddy.service", "caddy"}
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Test %d: Expected %v in archive, got %v", i, expected, names)
+		}
+	}
+}
+
+func TestCheckFormat(t *testing.T) {
+	for name, compression := range formats {
+		actual, err := checkFormat(name, "linux", "amd64", "")
+		if err != nil || actual != compression {
+			t.Errorf("Expected %s to be format %d, got %d (error: %v)", name, compression, actual, err)
+		}
+		if formatName(compression) != name {
+			t.Errorf("Expected format %d to be named %s, got %s", compression, name, formatName(compression))
+		}
+	}
+	for i, test := range []struct {
+		format, goOS, goArch, goARM string
+	}{
+		{"rar", "linux", "amd64", ""},
+		{"deb", "windows", "amd64", ""},
+		{"rpm", "darwin", "amd64", ""},
+		{"deb", "linux", "mips", ""},
+		{"rpm", "linux", "arm", "4"},
+		{"oci", "windows", "amd64", ""},
+		{"oci", "darwin", "amd64", ""}, // not static
+	} {
+		if _, err := checkFormat(test.format, test.goOS, test.goArch, test.goARM); err == nil {
+			t.Errorf("Test %d: Expected error for %s on %s/%s, but didn't get one", i, test.format, test.goOS, test.goArch)
+		}
+	}
+}
+
+func TestBuildHandlerFormat(t *testing.T) {
+	defer useFakeBuilds(t)()
+
+	for i, test := range []struct {
+		query            string
+		expectedStatus   int
+		expectedFilename string
+	}{
+		{"?os=linux&arch=amd64&format=nope", http.StatusBadRequest, ""},
+		{"?os=linux&arch=amd64", http.StatusOK, "caddy_linux_amd64_custom.tar.gz"},
+		{"?os=linux&arch=amd64&format=tar.gz", http.StatusOK, "caddy_linux_amd64_custom.tar.gz"},
+		{"?os=linux&arch=amd64&format=tar.xz", http.StatusOK, "caddy_linux_amd64_custom.tar.xz"},
+		{"?os=linux&arch=amd64&format=tar.zst", http.StatusOK, "caddy_linux_amd64_custom.tar.zst"},
+		{"?os=linux&arch=amd64&format=zip", http.StatusOK, "caddy_linux_amd64_custom.zip"},
+		{"?os=linux&arch=amd64&format=binary", http.StatusOK, "caddy_linux_amd64_custom"},
+		{"?os=linux&arch=amd64&format=tar.xz", http.StatusOK, "caddy_linux_amd64_custom.tar.xz"}, // cached
+		{"?os=windows&arch=amd64&format=binary", http.StatusOK, "caddy_windows_amd64_custom.exe"},
+	} {
+		req := httptest.NewRequest("GET", "/download/build"+test.query, nil)
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, req)
+
+		if rec.Code != test.expectedStatus {
+			t.Errorf("Test %d: Expected status %d, got %d: %s", i, test.expectedStatus, rec.Code, rec.Body.String())
+			continue
+		}
+		if test.expectedFilename == "" {
+			continue
+		}
+		if disposition := rec.Header().Get("Content-Disposition"); disposition != `attachment; filename="`+test.expectedFilename+`"` {
+			t.Errorf("Test %d: Expected download filename %s, got '%s'", i, test.expectedFilename, disposition)
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("Test %d: Expected ETag header, but there wasn't one", i)
+		}
+		if strings.HasSuffix(test.query, "format=binary") && !strings.HasPrefix(rec.Body.String(), "fake caddy") {
+			t.Errorf("Test %d: Expected raw binary, got %q", i, rec.Body.String())
+		}
+	}
+
+	buildsMutex.Lock()
+	var hashes []string
+	var linux *Build
+	for hash, b := range builds {
+		hashes = append(hashes, hash)
+		if b.GoOS == "linux" {
+			linux = b
+		}
+	}
+	buildsMutex.Unlock()
+	if len(hashes) != 2 {
+		t.Errorf("Expected 2 builds, got %d: %v", len(hashes), hashes)
+	}
+	defer func() {
+		for _, hash := range hashes {
+			deleteBuildJob(hash)
+		}
+	}()
+	if linux == nil {
+		t.Fatal("Expected a linux build")
+	}
+
+	// the other formats are kept with the build across restarts
+	loaded, err := loadBuild(filepath.Dir(linux.DownloadFile))
+	if err != nil {
+		t.Fatalf("Expected build to load, got %v", err)
+	}
+	var loadedFormats []string
+	for compression := range loaded.artifacts {
+		loadedFormats = append(loadedFormats, formatName(compression))
+	}
+	sort.Strings(loadedFormats)
+	expected := []string{"binary", "tar.xz", "tar.zst", "zip"}
+	if !reflect.DeepEqual(loadedFormats, expected) {
+		t.Errorf("Expected loaded artifacts %v, got %v", expected, loadedFormats)
+	}
+	if loaded.OutputFile != linux.OutputFile {
+		t.Errorf("Expected binary %s, got %s", linux.OutputFile, loaded.OutputFile)
+	}
+}
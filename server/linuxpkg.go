@@ -0,0 +1,200 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PackageMaintainer is the maintainer named in the Debian
+// and RPM packages of builds, as "Name <email>".
+var PackageMaintainer = "Caddy Build Server <builds@caddyserver.com>"
+
+// pkgName is the name of the Debian and RPM packages of builds.
+const pkgName = "caddy"
+
+// pkgFile is a file in a Linux package.
+type pkgFile struct {
+	Path string // absolute path on the system the package is installed on
+	Mode os.FileMode
+	Data []byte
+	Doc  bool // documentation, not needed to run
+	Conf bool // configuration, which upgrades keep if it was changed
+}
+
+// systemdUnit runs Caddy as a service with the Caddyfile in
+// /etc/caddy. It runs as a dynamic user that can only write
+// to /var/lib/caddy, which is where certificates are kept.
+const systemdUnit = `[Unit]
+Description=Caddy HTTP/2 web server
+Documentation=https://caddyserver.com/docs
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+ExecStart=/usr/bin/caddy -log stdout -agree=true -conf=/etc/caddy/Caddyfile -root=/var/tmp
+ExecReload=/bin/kill -USR1 $MAINPID
+Restart=on-failure
+DynamicUser=yes
+StateDirectory=caddy
+Environment=CADDYPATH=/var/lib/caddy
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+LimitNOFILE=1048576
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// defaultCaddyfile is the Caddyfile the service starts with.
+// It's a configuration file, so the sites users put in it
+// are kept when the package is upgraded.
+const defaultCaddyfile = `# This is the Caddyfile of the caddy service. Replace this
+# site with your own, then run: systemctl reload caddy
+# See https://caddyserver.com/docs/caddyfile
+
+:80
+root /usr/share/caddy
+`
+
+// defaultIndex is the page the default Caddyfile serves.
+const defaultIndex = `<!DOCTYPE html>
+<title>Caddy works!</title>
+<h1>Caddy works!</h1>
+<p>Edit /etc/caddy/Caddyfile to serve your own site.</p>
+`
+
+// packageFiles returns the files of the Linux packages of b:
+// the binary, a systemd unit in unitDir, the default Caddyfile
+// with the page it serves, and the distribution
+// files and build info as documentation. The init scripts in
+// Caddy's dist folder are included as examples.
+func (b *Build) packageFiles(unitDir string) ([]pkgFile, error) {
+	binary, err := ioutil.ReadFile(b.OutputFile)
+	if err != nil {
+		return nil, err
+	}
+	files := []pkgFile{
+		{Path: "/usr/bin/caddy", Mode: 0755, Data: binary},
+		{Path: path.Join(unitDir, "caddy.service"), Mode: 0644, Data: []byte(systemdUnit)},
+		{Path: "/etc/caddy/Caddyfile", Mode: 0644, Data: []byte(defaultCaddyfile), Conf: true},
+		{Path: "/usr/share/caddy/index.html", Mode: 0644, Data: []byte(defaultIndex)},
+	}
+
+	docDir := "/usr/share/doc/" + pkgName
+	for _, file := range b.distFiles(nil) {
+		if file == b.OutputFile {
+			continue
+		}
+		err := filepath.Walk(file, func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			rel, err := filepath.Rel(filepath.Dir(file), p)
+			if err != nil {
+				return err
+			}
+			data, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			files = append(files, pkgFile{
+				Path: path.Join(docDir, filepath.ToSlash(rel)),
+				Mode: info.Mode().Perm(),
+				Data: data,
+				Doc:  true,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
+
+// packageVersion returns the version of the Linux packages
+// of b. It's the Caddy version if one was chosen, with the
+// pre-release separated by a tilde so it sorts before the
+// release; otherwise, it's made from when b was created, so
+// newer custom builds upgrade older ones.
+func (b *Build) packageVersion() string {
+	if b.CaddyVersion == "" {
+		return "0.0.0+" + b.Created.UTC().Format("20060102150405")
+	}
+	return strings.Replace(strings.TrimPrefix(b.CaddyVersion, "v"), "-", "~", 1)
+}
+
+// packageDescription returns the long description of the
+// Linux packages of b, which lists the included plugins.
+func (b *Build) packageDescription() string {
+	var names []string
+	for _, plugin := range b.Features {
+		if plugin.Name != "" {
+			names = append(names, plugin.Spec())
+		}
+	}
+	desc := "Caddy is a general-purpose HTTP/2 web server that serves HTTPS by default.\n" +
+		"This is a custom build with these plugins: " + strings.Join(names, ", ") + ".\n" +
+		"Build: " + b.Hash
+	return desc
+}
+
+// debArch and rpmArch map GOARCH to the architecture
+// names of Debian and RPM packages, respectively. For
+// ARM, the names depend on GOARM.
+var (
+	debArch = map[string]string{
+		"386":      "i386",
+		"amd64":    "amd64",
+		"arm5":     "armel",
+		"arm6":     "armel",
+		"arm7":     "armhf",
+		"arm64":    "arm64",
+		"mips64":   "mips64",
+		"mips64le": "mips64el",
+		"ppc64":    "ppc64",
+		"ppc64le":  "ppc64el",
+		"s390x":    "s390x",
+	}
+	rpmArch = map[string]string{
+		"386":      "i386",
+		"amd64":    "x86_64",
+		"arm5":     "armv5tel",
+		"arm6":     "armv6hl",
+		"arm7":     "armv7hl",
+		"arm64":    "aarch64",
+		"mips64":   "mips64",
+		"mips64le": "mips64el",
+		"ppc64":    "ppc64",
+		"ppc64le":  "ppc64le",
+		"s390x":    "s390x",
+	}
+)
+
+// packageArch returns the name of goArch (and goARM)
+// in archs, or an error if it has none.
+func packageArch(archs map[string]string, goOS, goArch, goARM string) (string, error) {
+	if goOS != "linux" {
+		return "", fmt.Errorf("packages are only made for linux, not %s", goOS)
+	}
+	key := goArch
+	if goArch == "arm" {
+		if goARM == "" {
+			goARM = fmt.Sprint(defaultARM)
+		}
+		key += goARM
+	}
+	arch, ok := archs[key]
+	if !ok {
+		return "", fmt.Errorf("packages are not made for %s/%s", goOS, goArch)
+	}
+	return arch, nil
+}
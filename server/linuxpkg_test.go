@@ -0,0 +1,276 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPackageArch(t *testing.T) {
+	for i, test := range []struct {
+		archs               map[string]string
+		goOS, goArch, goARM string
+		expected            string
+		shouldErr           bool
+	}{
+		{debArch, "linux", "amd64", "", "amd64", false},
+		{rpmArch, "linux", "amd64", "", "x86_64", false},
+		{debArch, "linux", "arm", "7", "armhf", false},
+		{debArch, "linux", "arm", "", "armhf", false}, // defaultARM
+		{rpmArch, "linux", "arm", "6", "armv6hl", false},
+		{rpmArch, "linux", "arm", "4", "", true},
+		{debArch, "linux", "mips", "", "", true},
+		{debArch, "freebsd", "amd64", "", "", true},
+	} {
+		actual, err := packageArch(test.archs, test.goOS, test.goArch, test.goARM)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %d: Expected error, but didn't get one", i)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %d: Expected no error, got %v", i, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected arch '%s', got '%s'", i, test.expected, actual)
+		}
+	}
+}
+
+func TestPackageVersion(t *testing.T) {
+	created := time.Date(2017, 3, 4, 5, 6, 7, 0, time.UTC)
+	for i, test := range []struct {
+		caddyVersion, expected string
+	}{
+		{"", "0.0.0+20170304050607"},
+		{"v0.9.5", "0.9.5"},
+		{"v0.10.0-beta.1", "0.10.0~beta.1"},
+	} {
+		b := &Build{CaddyVersion: test.caddyVersion, Created: created}
+		if actual := b.packageVersion(); actual != test.expected {
+			t.Errorf("Test %d: Expected version %s, got %s", i, test.expected, actual)
+		}
+	}
+}
+
+func TestBuildHandlerLinuxPackages(t *testing.T) {
+	defer useFakeBuilds(t)()
+
+	// Debian package: an ar archive of debian-binary,
+	// control.tar.gz and data.tar.gz, in that order
+	rec := httptest.NewRecorder()
+	BuildHandler(rec, httptest.NewRequest("GET", "/download/build?os=linux&arch=amd64&format=deb", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200 for deb, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); !strings.HasSuffix(disposition, `custom.deb"`) {
+		t.Errorf("Expected .deb download, got '%s'", disposition)
+	}
+	members, err := readAr(rec.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Expected valid ar archive, got %v", err)
+	}
+	var names []string
+	for _, m := range members {
+		names = append(names, m.name)
+	}
+	if strings.Join(names, " ") != "debian-binary control.tar.gz data.tar.gz" {
+		t.Fatalf("Expected debian-binary, control.tar.gz and data.tar.gz, got %v", names)
+	}
+	if string(members[0].data) != "2.0\n" {
+		t.Errorf("Expected package format 2.0, got %q", members[0].data)
+	}
+	control, err := readTarGz(members[1].data)
+	if err != nil {
+		t.Fatalf("Expected valid control tarball, got %v", err)
+	}
+	for _, field := range []string{"Package: caddy\n", "Architecture: amd64\n", "Version: 0.0.0+", "Maintainer: " + PackageMaintainer + "\n"} {
+		if !strings.Contains(control["./control"], field) {
+			t.Errorf("Expected control file to contain %q, got:\n%s", field, control["./control"])
+		}
+	}
+	if !strings.Contains(PackageMaintainer, " <") || !strings.HasSuffix(PackageMaintainer, ">") {
+		t.Errorf("Expected maintainer as 'Name <email>', got '%s'", PackageMaintainer)
+	}
+	if control["./conffiles"] != "/etc/caddy/Caddyfile\n" {
+		t.Errorf("Expected the Caddyfile in conffiles, got %q", control["./conffiles"])
+	}
+	data, err := readTarGz(members[2].data)
+	if err != nil {
+		t.Fatalf("Expected valid data tarball, got %v", err)
+	}
+	if !strings.HasPrefix(data["./usr/bin/caddy"], "fake caddy") {
+		t.Errorf("Expected binary in ./usr/bin/caddy, got %q", data["./usr/bin/caddy"])
+	}
+	if !strings.Contains(data["./lib/systemd/system/caddy.service"], "ExecStart=/usr/bin/caddy") {
+		t.Errorf("Expected systemd unit, got %q", data["./lib/systemd/system/caddy.service"])
+	}
+	if !strings.Contains(data["./lib/systemd/system/caddy.service"], "-conf=/etc/caddy/Caddyfile") ||
+		!strings.Contains(data["./etc/caddy/Caddyfile"], "root /usr/share/caddy") {
+		t.Errorf("Expected the Caddyfile the unit uses, got %q", data["./etc/caddy/Caddyfile"])
+	}
+	if _, ok := data["./usr/share/caddy/index.html"]; !ok {
+		t.Errorf("Expected the page the Caddyfile serves, got %v", data)
+	}
+	if _, ok := data["./usr/share/doc/caddy/"+buildInfoFilename]; !ok {
+		t.Errorf("Expected build info in the docs, got %v", data)
+	}
+
+	// RPM package: lead, signature header, header, payload
+	rec = httptest.NewRecorder()
+	BuildHandler(rec, httptest.NewRequest("GET", "/download/build?os=linux&arch=amd64&format=rpm", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200 for rpm, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rpm := rec.Body.Bytes()
+	if len(rpm) < 96 || !bytes.Equal(rpm[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("Expected RPM lead")
+	}
+	rest := rpm[96:]
+	sigLen, err := checkRPMHeader(rest, rpmTagHeaderSignatures)
+	if err != nil {
+		t.Fatalf("Expected valid signature header, got %v", err)
+	}
+	sigLen = (sigLen + 7) &^ 7
+	rest = rest[sigLen:]
+	hdrLen, err := checkRPMHeader(rest, rpmTagHeaderImmutable)
+	if err != nil {
+		t.Fatalf("Expected valid header, got %v", err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(rest[hdrLen:]))
+	if err != nil {
+		t.Fatalf("Expected gzipped payload, got %v", err)
+	}
+	payload, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Expected gzipped payload, got %v", err)
+	}
+	if !bytes.HasPrefix(payload, []byte("070701")) {
+		t.Errorf("Expected cpio newc payload, got %q", payload[:6])
+	}
+	for _, name := range []string{"./usr/bin/caddy\x00", "./usr/lib/systemd/system/caddy.service\x00", "./etc/caddy/Caddyfile\x00", "TRAILER!!!\x00"} {
+		if !bytes.Contains(payload, []byte(name)) {
+			t.Errorf("Expected %q in payload, but it wasn't", name)
+		}
+	}
+
+	// packages are only made for linux
+	rec = httptest.NewRecorder()
+	BuildHandler(rec, httptest.NewRequest("GET", "/download/build?os=windows&arch=amd64&format=deb", nil))
+	if rec.Code != 400 {
+		t.Errorf("Expected status 400 for windows deb, got %d", rec.Code)
+	}
+
+	buildsMutex.Lock()
+	var hashes []string
+	for hash := range builds {
+		hashes = append(hashes, hash)
+	}
+	buildsMutex.Unlock()
+	if len(hashes) != 1 {
+		t.Errorf("Expected 1 build, got %d: %v", len(hashes), hashes)
+	}
+	for _, hash := range hashes {
+		deleteBuildJob(hash)
+	}
+}
+
+type arMember struct {
+	name string
+	data []byte
+}
+
+// readAr returns the members of the ar archive in data.
+func readAr(data []byte) ([]arMember, error) {
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data = data[8:]
+	var members []arMember
+	for len(data) >= 60 {
+		size, err := strconv.Atoi(strings.TrimSpace(string(data[48:58])))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 60+size {
+			return nil, io.ErrUnexpectedEOF
+		}
+		members = append(members, arMember{
+			name: strings.TrimSpace(string(data[:16])),
+			data: data[60 : 60+size],
+		})
+		data = data[60+size+size%2:]
+	}
+	return members, nil
+}
+
+// readTarGz returns the contents of the files in a gzipped
+// tarball by name; directories map to "".
+func readTarGz(data []byte) (map[string]string, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Uname != "root" {
+			return nil, io.ErrUnexpectedEOF
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = string(contents)
+	}
+}
+
+// checkRPMHeader checks the structure of the RPM header at the
+// start of data, whose region tag should be regionTag, and returns
+// its length.
+func checkRPMHeader(data []byte, regionTag int32) (int, error) {
+	if len(data) < 16 || !bytes.Equal(data[:4], []byte{0x8e, 0xad, 0xe8, 0x01}) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	il := int(binary.BigEndian.Uint32(data[8:]))
+	dl := int(binary.BigEndian.Uint32(data[12:]))
+	length := 16 + il*16 + dl
+	if len(data) < length {
+		return 0, io.ErrUnexpectedEOF
+	}
+	index, store := data[16:16+il*16], data[16+il*16:length]
+	var lastTag int32
+	for i := 0; i < il; i++ {
+		tag := int32(binary.BigEndian.Uint32(index[i*16:]))
+		if i == 0 && tag != regionTag {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if i > 1 && tag <= lastTag {
+			return 0, io.ErrUnexpectedEOF // must be sorted
+		}
+		lastTag = tag
+	}
+	// the region trailer points back at the whole index
+	offset := int(binary.BigEndian.Uint32(index[8:]))
+	if offset+16 > len(store) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	trailer := store[offset : offset+16]
+	if int32(binary.BigEndian.Uint32(trailer)) != regionTag || int32(binary.BigEndian.Uint32(trailer[8:])) != int32(-il*16) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return length, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFile is a log file that is rotated when it grows beyond
+// MaxSize or has been written to for longer than MaxAge. The
+// old file is renamed with the time it was rotated appended,
+// and only the newest MaxBackups of those are kept. It is safe
+// for concurrent use.
+type LogFile struct {
+	Path       string
+	MaxSize    int64         // in bytes; 0 for no limit
+	MaxAge     time.Duration // 0 for no limit
+	MaxBackups int           // 0 keeps all
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// rotatedSuffix is the layout of the time appended to
+// the names of rotated log files; they sort by it.
+const rotatedSuffix = ".20060102-150405.000"
+
+// Write appends p to the log file, rotating it first if needed.
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	if (l.MaxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.MaxSize) ||
+		(l.MaxAge > 0 && time.Since(l.opened) > l.MaxAge) {
+		if err := l.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.f.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// Close closes the log file; it is opened again if written to.
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// open opens the log file for appending.
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f, l.size, l.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// rotate renames the log file, opens a new one and
+// deletes the rotated files beyond MaxBackups.
+func (l *LogFile) rotate() error {
+	err := l.f.Close()
+	l.f = nil
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.Path, l.Path+time.Now().UTC().Format(rotatedSuffix))
+	if err != nil {
+		return err
+	}
+	err = l.open()
+	if err != nil {
+		return err
+	}
+
+	if l.MaxBackups <= 0 {
+		return nil
+	}
+	matches, _ := filepath.Glob(l.Path + ".*")
+	var rotated []string
+	for _, name := range matches {
+		if _, err := time.Parse(rotatedSuffix, strings.TrimPrefix(name, l.Path)); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > l.MaxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "builds.log")
+	ioutil.WriteFile(path+".tmp", []byte("not a rotated log"), 0644)
+	l := &LogFile{Path: path, MaxSize: 10, MaxBackups: 2}
+	defer l.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := l.Write([]byte("123456789\n")); err != nil {
+			t.Fatalf("Write %d: Expected no error, got %v", i, err)
+		}
+		time.Sleep(2 * time.Millisecond) // so rotated names differ
+	}
+
+	matches, _ := filepath.Glob(path + ".*")
+	var rotated int
+	for _, name := range matches {
+		if !strings.HasSuffix(name, ".tmp") {
+			rotated++
+		}
+	}
+	if rotated != 2 {
+		t.Errorf("Expected 2 rotated files, got %d: %v", rotated, matches)
+	}
+	if _, err := os.Stat(path + ".tmp"); err != nil {
+		t.Errorf("Expected other files to be left alone, got %v", err)
+	}
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "123456789\n" {
+		t.Errorf("Expected only the last line in the current file, got %q", data)
+	}
+
+	// rotated by age, too
+	l.MaxSize, l.MaxAge = 0, time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	l.Write([]byte("later\n"))
+	data, _ = ioutil.ReadFile(path)
+	if string(data) != "later\n" {
+		t.Errorf("Expected the file to be rotated after MaxAge, got %q", data)
+	}
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// The levels of log entries, from least to most severe.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLevel returns the level with the given name,
+// like "info".
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return 0, errors.New("unknown log level '" + name + "'")
+}
+
+var (
+	// logMu protects the settings below, which are set with
+	// SetLogOutput and Config.Apply, and keeps log entries
+	// from being interleaved.
+	logMu sync.Mutex
+
+	// logLevel is the least severe level that is logged.
+	logLevel = LevelInfo
+
+	// logFormat is the format of log entries: "logfmt",
+	// with one key=value pair per field, or "json".
+	logFormat = "logfmt"
+
+	// logOutput is where log entries are written.
+	logOutput io.Writer = os.Stderr
+)
+
+// SetLogOutput sets where log entries are written;
+// os.Stderr by default.
+func SetLogOutput(w io.Writer) {
+	logMu.Lock()
+	logOutput = w
+	logMu.Unlock()
+}
+
+// setLogFormat sets the format of log entries
+// and the least severe level that is logged.
+func setLogFormat(format string, level Level) {
+	logMu.Lock()
+	logFormat, logLevel = format, level
+	logMu.Unlock()
+}
+
+// logSettings returns the current log output, format and level.
+func logSettings() (io.Writer, string, Level) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logOutput, logFormat, logLevel
+}
+
+// Log writes a log entry with the given level and message, if
+// the level is logged, for code outside this package. The fields
+// of the entry are given as alternating keys and values in kv.
+func Log(level Level, msg string, kv ...interface{}) {
+	logEntry(level, msg, kv...)
+}
+
+// logEntry writes a log entry with the given level and message
+// if the level is logged. The fields of the entry are given as
+// alternating keys and values in kv. Errors and durations are
+// written as strings.
+func logEntry(level Level, msg string, kv ...interface{}) {
+	_, format, minLevel := logSettings()
+	if level < minLevel {
+		return
+	}
+	kv = append([]interface{}{"ts", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+		"level", level.String(), "msg", msg}, kv...)
+
+	var buf bytes.Buffer
+	if format == "json" {
+		buf.WriteByte('{')
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		value := kv[i+1]
+		switch v := value.(type) {
+		case error:
+			value = v.Error()
+		case time.Duration:
+			value = v.String()
+		case fmt.Stringer:
+			value = v.String()
+		}
+		if format == "json" {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			k, _ := json.Marshal(key)
+			v, err := json.Marshal(value)
+			if err != nil {
+				v, _ = json.Marshal(fmt.Sprint(value))
+			}
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(v)
+			continue
+		}
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(logfmtValue(fmt.Sprint(value)))
+	}
+	if format == "json" {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+
+	logMu.Lock()
+	logOutput.Write(buf.Bytes())
+	logMu.Unlock()
+}
+
+// logfmtValue quotes s if it has to be for logfmt.
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func logDebug(msg string, kv ...interface{}) { logEntry(LevelDebug, msg, kv...) }
+func logInfo(msg string, kv ...interface{})  { logEntry(LevelInfo, msg, kv...) }
+func logWarn(msg string, kv ...interface{})  { logEntry(LevelWarn, msg, kv...) }
+func logError(msg string, kv ...interface{}) { logEntry(LevelError, msg, kv...) }
+
+// StandardLogWriter returns a writer that turns each line
+// written to it into an entry at the info level. Set it as
+// the output of the standard log package (without flags) so
+// everything is logged the same way.
+func StandardLogWriter() io.Writer {
+	return stdLogWriter{}
+}
+
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		logInfo(line)
+	}
+	return len(p), nil
+}
+
+// logFields returns the fields that identify b in log entries.
+func (b *Build) logFields() []interface{} {
+	platform := b.GoOS + "/" + b.GoArch
+	if b.GoARM != "" {
+		platform += "/v" + b.GoARM
+	}
+	kv := []interface{}{"job", b.ID, "hash", b.Hash, "platform", platform, "features", b.Features.SpecString()}
+	if b.CaddyVersion != "" {
+		kv = append(kv, "version", b.CaddyVersion)
+	}
+	if b.RequestID != "" {
+		kv = append(kv, "request_id", b.RequestID)
+	}
+	return kv
+}
+
+// RequestIDHeader is the header that identifies a request
+// in the logs. If clients (or a proxy in front of the build
+// server) don't set it, a random ID is made up.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// validRequestID matches request IDs from clients that are
+// safe to use; others are replaced.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestIDHandler gives each request that h handles an ID,
+// which is sent back in the RequestIDHeader and goes with
+// the request (and any build job it starts) in the logs.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newJobID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestID returns the ID of r, or "" if it has none.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends log entries to a buffer in the given
+// format until the returned function is called.
+func captureLogs(format string) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	oldOutput, oldFormat, oldLevel := logSettings()
+	SetLogOutput(&buf)
+	setLogFormat(format, LevelInfo)
+	return &buf, func() {
+		SetLogOutput(oldOutput)
+		setLogFormat(oldFormat, oldLevel)
+	}
+}
+
+func TestLogEntry(t *testing.T) {
+	ts := regexp.MustCompile(`\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{3}Z`)
+	for i, test := range []struct {
+		format   string
+		level    Level
+		kv       []interface{}
+		expected string
+	}{
+		{"logfmt", LevelInfo, []interface{}{"hash", "linux:amd64::", "duration", 1500 * time.Millisecond},
+			`ts=TS level=info msg="build done" hash=linux:amd64:: duration=1.5s` + "\n"},
+		{"logfmt", LevelError, []interface{}{"error", errors.New(`bad "thing"`), "empty", ""},
+			`ts=TS level=error msg="build done" error="bad \"thing\"" empty=""` + "\n"},
+		{"json", LevelWarn, []interface{}{"status", 500, "error", errors.New("oops")},
+			`{"ts":"TS","level":"warn","msg":"build done","status":500,"error":"oops"}` + "\n"},
+		{"logfmt", LevelDebug, nil, ""}, // below the level logged
+	} {
+		buf, restore := captureLogs(test.format)
+		logEntry(test.level, "build done", test.kv...)
+		restore()
+
+		actual := ts.ReplaceAllString(buf.String(), "TS")
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected %q, got %q", i, test.expected, actual)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		actual, err := ParseLevel(strings.ToUpper(level.String()))
+		if err != nil || actual != level {
+			t.Errorf("Expected level %s, got %s (error: %v)", level, actual, err)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected error for unknown level, but didn't get one")
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var seen string
+	h := RequestIDHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+	}))
+	for i, test := range []struct {
+		header    string
+		generated bool
+	}{
+		{"abc-123", false},
+		{"", true},
+		{"has spaces", true},
+		{strings.Repeat("x", 129), true},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.header != "" {
+			req.Header.Set(RequestIDHeader, test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if seen == "" || rec.Header().Get(RequestIDHeader) != seen {
+			t.Errorf("Test %d: Expected request ID '%s' in response, got '%s'", i, seen, rec.Header().Get(RequestIDHeader))
+		}
+		if !test.generated && seen != test.header {
+			t.Errorf("Test %d: Expected request ID '%s', got '%s'", i, test.header, seen)
+		}
+		if test.generated && seen == test.header {
+			t.Errorf("Test %d: Expected a new request ID, got the client's", i)
+		}
+	}
+}
+
+func TestBuildJobLogs(t *testing.T) {
+	defer useFakeBuilds(t)()
+	buf, restore := captureLogs("json")
+	defer restore()
+
+	req := httptest.NewRequest("GET", "/download/build?os=linux&arch=arm&arm=6", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	rec := httptest.NewRecorder()
+	RequestIDHandler(http.HandlerFunc(BuildHandler)).ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	buildsMutex.Lock()
+	var hashes []string
+	for hash := range builds {
+		hashes = append(hashes, hash)
+	}
+	buildsMutex.Unlock()
+	for _, hash := range hashes {
+		deleteBuildJob(hash)
+	}
+
+	var msgs []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected JSON log entry, got %q: %v", line, err)
+		}
+		msg, _ := entry["msg"].(string)
+		if !strings.HasPrefix(msg, "build ") {
+			continue
+		}
+		msgs = append(msgs, msg)
+		for key, expected := range map[string]interface{}{
+			"request_id": "req-42",
+			"platform":   "linux/arm/v6",
+		} {
+			if entry[key] != expected {
+				t.Errorf("Expected %s '%v' in '%s' entry, got '%v'", key, expected, msg, entry[key])
+			}
+		}
+		if hash, _ := entry["hash"].(string); !strings.HasPrefix(hash, "linux:arm:6:") {
+			t.Errorf("Expected hash of the build in '%s' entry, got '%s'", msg, hash)
+		}
+		if msg == "build succeeded" && entry["duration"] == nil {
+			t.Errorf("Expected duration in '%s' entry, but there wasn't one", msg)
+		}
+	}
+	if strings.Join(msgs, ", ") != "build started, build succeeded" {
+		t.Errorf("Expected build started and succeeded entries, got %v", msgs)
+	}
+}
+
+func TestLogSettingsConcurrent(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			logInfo("busy", "i", i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		SetLogOutput(&bytes.Buffer{})
+		setLogFormat("json", LevelWarn)
+		setLogFormat("logfmt", LevelInfo)
+	}
+	<-done
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// manifestFilename is the name of the file in each build's
+// folder that describes the build so it can be reloaded.
+const manifestFilename = "manifest.json"
+
+// manifest is the on-disk record of a finished build. File
+// names are relative to the folder the manifest is in.
+type manifest struct {
+	Hash                    string             `json:"hash"`
+	ID                      string             `json:"id"`
+	GoOS                    string             `json:"os"`
+	GoArch                  string             `json:"arch"`
+	GoARM                   string             `json:"arm,omitempty"`
+	CaddyVersion            string             `json:"version,omitempty"`
+	Features                []string           `json:"features"`
+	Binary                  string             `json:"binary"`
+	DownloadFile            string             `json:"download_file"`
+	DownloadFilename        string             `json:"download_filename"`
+	DownloadFileCompression int                `json:"download_compression"`
+	LogFile                 string             `json:"log_file"`
+	SignatureFile           string             `json:"signature_file,omitempty"`
+	Checksum                string             `json:"sha256"`
+	Sources                 string             `json:"sources,omitempty"`
+	Artifacts               []manifestArtifact `json:"artifacts,omitempty"`
+	Created                 time.Time          `json:"created"`
+	Finished                time.Time          `json:"finished"`
+}
+
+// manifestArtifact is the on-disk record of an artifact
+// that was made from a build after it finished.
+type manifestArtifact struct {
+	File          string `json:"file"`
+	Filename      string `json:"filename"`
+	Compression   int    `json:"compression"`
+	SignatureFile string `json:"signature_file,omitempty"`
+	Checksum      string `json:"sha256"`
+}
+
+// saveManifest writes the manifest of b into its folder. The
+// manifest is written last, so a folder with a manifest in it
+// contains a complete build.
+func (b *Build) saveManifest() error {
+	m := manifest{
+		Hash:                    b.Hash,
+		ID:                      b.ID,
+		GoOS:                    b.GoOS,
+		GoArch:                  b.GoArch,
+		GoARM:                   b.GoARM,
+		CaddyVersion:            b.CaddyVersion,
+		Features:                b.Features.Specs(),
+		Binary:                  filepath.Base(b.OutputFile),
+		DownloadFile:            filepath.Base(b.DownloadFile),
+		DownloadFilename:        b.DownloadFilename,
+		DownloadFileCompression: b.DownloadFileCompression,
+		LogFile:                 filepath.Base(b.LogFile),
+		Checksum:                b.Checksum,
+		Created:                 b.Created,
+		Finished:                time.Now(),
+	}
+	if b.SignatureFile != "" {
+		m.SignatureFile = filepath.Base(b.SignatureFile)
+	}
+	b.mu.Lock()
+	m.Sources = b.sources
+	for _, a := range b.artifacts {
+		ma := manifestArtifact{
+			File:        filepath.Base(a.File),
+			Filename:    a.Filename,
+			Compression: a.Compression,
+			Checksum:    a.Checksum,
+		}
+		if a.SignatureFile != "" {
+			ma.SignatureFile = filepath.Base(a.SignatureFile)
+		}
+		m.Artifacts = append(m.Artifacts, ma)
+	}
+	b.mu.Unlock()
+	sort.Slice(m.Artifacts, func(i, j int) bool {
+		return m.Artifacts[i].Compression < m.Artifacts[j].Compression
+	})
+
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash can't leave a
+	// half-written manifest behind
+	dir := filepath.Dir(b.DownloadFile)
+	tmp := filepath.Join(dir, manifestFilename+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, manifestFilename))
+}
+
+// LoadBuilds loads the finished builds in dir so they can be
+// served without building them again. Expired builds are left
+// for the next eviction to clean up. Folders in dir that do
+// not contain a usable build (for example, because the build
+// failed or was interrupted) are deleted. It is not an error
+// if dir does not exist.
+func LoadBuilds(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var loaded int
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		buildDir := filepath.Join(dir, entry.Name())
+
+		b, err := loadBuild(buildDir)
+		if err != nil {
+			logWarn("discarding build", "dir", buildDir, "error", err)
+			err = os.RemoveAll(buildDir)
+			if err != nil {
+				logError("deleting build", "dir", buildDir, "error", err)
+			}
+			continue
+		}
+
+		buildsMutex.Lock()
+		_, dup := builds[b.Hash]
+		if !dup {
+			builds[b.Hash] = b
+			jobs[b.ID] = b
+		}
+		buildsMutex.Unlock()
+		if dup {
+			logWarn("discarding build", "dir", buildDir, "hash", b.Hash, "error", "duplicate")
+			err = os.RemoveAll(buildDir)
+			if err != nil {
+				logError("deleting build", "dir", buildDir, "error", err)
+			}
+			continue
+		}
+
+		loaded++
+	}
+
+	logInfo("loaded builds", "count", loaded, "dir", dir)
+	return nil
+}
+
+// loadBuild reads the manifest in dir and returns the
+// finished build it describes.
+func loadBuild(dir string) (*Build, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFilename))
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest: %v", err)
+	}
+
+	// Make sure the build is still what we would build today
+	orderedFeatures, err := features.Current().Resolve(m.Features)
+	if err != nil {
+		return nil, err
+	}
+	if hash := buildHash(m.GoOS, m.GoArch, m.GoARM, buildFeatures(m.CaddyVersion, orderedFeatures)); hash != m.Hash {
+		return nil, fmt.Errorf("build hash changed from %s to %s", m.Hash, hash)
+	}
+
+	b := &Build{
+		ID:                      m.ID,
+		DoneChan:                make(chan struct{}),
+		OutputFile:              filepath.Join(dir, m.Binary),
+		DownloadFile:            filepath.Join(dir, m.DownloadFile),
+		DownloadFilename:        m.DownloadFilename,
+		DownloadFileCompression: m.DownloadFileCompression,
+		LogFile:                 filepath.Join(dir, m.LogFile),
+		Checksum:                m.Checksum,
+		GoOS:                    m.GoOS,
+		GoArch:                  m.GoArch,
+		GoARM:                   m.GoARM,
+		CaddyVersion:            m.CaddyVersion,
+		Features:                orderedFeatures,
+		Hash:                    m.Hash,
+		Created:                 m.Created,
+		finished:                true,
+		output:                  newBuildLog(),
+		state:                   JobSucceeded,
+		ended:                   m.Finished,
+	}
+	close(b.DoneChan)
+	if BuildExpiry > 0 {
+		b.Expires = m.Finished.Add(BuildExpiry)
+	}
+	b.platform, _ = allowed.get(b.GoOS, b.GoArch)
+
+	// and that it was made from the sources we would build it
+	// from today, since checkouts and modules can be updated
+	b.sources = builderSources(b.target())
+	if b.sources != m.Sources {
+		return nil, fmt.Errorf("sources changed since build")
+	}
+
+	_, err = os.Stat(b.DownloadFile)
+	if err != nil {
+		return nil, err
+	}
+	// the binary is kept to make other formats from
+	info, err := os.Stat(b.OutputFile)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("binary %s is not a file", m.Binary)
+	}
+	for _, ma := range m.Artifacts {
+		a := artifact{
+			File:        filepath.Join(dir, ma.File),
+			Filename:    ma.Filename,
+			Compression: ma.Compression,
+			Checksum:    ma.Checksum,
+		}
+		if _, err := os.Stat(a.File); err != nil {
+			continue // can be made again
+		}
+		if ma.SignatureFile != "" {
+			a.SignatureFile = filepath.Join(dir, ma.SignatureFile)
+		}
+		a.size = a.diskSize()
+		a.lastAccess = m.Finished
+		if b.artifacts == nil {
+			b.artifacts = make(map[int]artifact)
+		}
+		b.artifacts[a.Compression] = a
+	}
+	b.updateSize()
+	b.lastAccess = m.Finished
+	if m.SignatureFile != "" {
+		b.SignatureFile = filepath.Join(dir, m.SignatureFile)
+	}
+	if b.Checksum == "" {
+		b.Checksum, err = checksumFile(b.DownloadFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The log is nice to have, but not essential
+	logData, err := ioutil.ReadFile(b.LogFile)
+	if err == nil {
+		b.output.Write(logData)
+	}
+	b.output.Close()
+
+	return b, nil
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// sourcesBuilder is a FakeBuilder that
+// builds everything from the same sources.
+type sourcesBuilder struct {
+	FakeBuilder
+	src string
+}
+
+func (sb sourcesBuilder) sources(Target) string { return sb.src }
+
+func TestLoadBuilds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldBuilder := DefaultBuilder
+	DefaultBuilder = sourcesBuilder{src: "rev1"}
+	defer func() { DefaultBuilder = oldBuilder }()
+
+	// A complete build
+	goodDir := filepath.Join(dir, "good")
+	os.Mkdir(goodDir, 0755)
+	orderedFeatures, err := features.Current().Resolve([]string{"HTTP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Build{
+		ID:               "goodid",
+		OutputFile:       filepath.Join(goodDir, "caddy"),
+		DownloadFile:     filepath.Join(goodDir, "caddy_linux_amd64_custom.tar.gz"),
+		DownloadFilename: "caddy_linux_amd64_custom.tar.gz",
+		LogFile:          filepath.Join(goodDir, "build.log"),
+		GoOS:             "linux",
+		GoArch:           "amd64",
+		Features:         orderedFeatures,
+		Hash:             buildHash("linux", "amd64", "", orderedFeatures.String()),
+		Created:          time.Now(),
+	}
+	ioutil.WriteFile(b.OutputFile, []byte("binary"), 0755)
+	ioutil.WriteFile(b.DownloadFile, []byte("archive"), 0644)
+	ioutil.WriteFile(b.LogFile, []byte("it worked\n"), 0644)
+	b.sources = builderSources(b.target())
+	if err := b.saveManifest(); err != nil {
+		t.Fatalf("Expected no error saving manifest, got %v", err)
+	}
+
+	// A build whose binary is gone
+	noBinaryDir := filepath.Join(dir, "nobinary")
+	os.Mkdir(noBinaryDir, 0755)
+	nb := &Build{
+		ID:           "nobinaryid",
+		OutputFile:   filepath.Join(noBinaryDir, "caddy"),
+		DownloadFile: filepath.Join(noBinaryDir, "caddy_linux_amd64_custom.tar.gz"),
+		GoOS:         "linux",
+		GoArch:       "arm64",
+		Features:     orderedFeatures,
+		Hash:         buildHash("linux", "arm64", "", orderedFeatures.String()),
+		sources:      b.sources,
+	}
+	ioutil.WriteFile(nb.DownloadFile, []byte("archive"), 0644)
+	nb.saveManifest()
+
+	// An incomplete build
+	badDir := filepath.Join(dir, "bad")
+	os.Mkdir(badDir, 0755)
+	ioutil.WriteFile(filepath.Join(badDir, "caddy"), []byte("binary"), 0644)
+
+	if err := LoadBuilds(dir); err != nil {
+		t.Fatalf("Expected no error loading builds, got %v", err)
+	}
+	defer deleteBuildJob(b.Hash)
+
+	buildsMutex.Lock()
+	loaded, ok := builds[b.Hash]
+	_, jobOK := jobs[b.ID]
+	buildsMutex.Unlock()
+	if !ok || !jobOK {
+		t.Fatal("Expected build to be loaded, but it wasn't")
+	}
+	if loaded.State() != JobSucceeded {
+		t.Errorf("Expected loaded build to have succeeded, got %s", loaded.State())
+	}
+	if loaded.DownloadFile != b.DownloadFile {
+		t.Errorf("Expected download file %s, got %s", b.DownloadFile, loaded.DownloadFile)
+	}
+	if loaded.OutputFile != b.OutputFile {
+		t.Errorf("Expected binary %s, got %s", b.OutputFile, loaded.OutputFile)
+	}
+	if data, _, _ := loaded.output.read(0); string(data) != "it worked\n" {
+		t.Errorf("Expected log to be loaded, got '%s'", data)
+	}
+	select {
+	case <-loaded.DoneChan:
+	default:
+		t.Error("Expected DoneChan of loaded build to be closed")
+	}
+
+	if _, err := os.Stat(badDir); !os.IsNotExist(err) {
+		t.Error("Expected incomplete build to be deleted")
+	}
+	if _, err := os.Stat(noBinaryDir); !os.IsNotExist(err) {
+		t.Error("Expected build without binary to be deleted")
+	}
+}
+
+func TestLoadBuildsStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	staleDir := filepath.Join(dir, "stale")
+	os.Mkdir(staleDir, 0755)
+	b := &Build{
+		DownloadFile: filepath.Join(staleDir, "caddy.zip"),
+		Features:     features.Plugins{{Name: "no-longer-registered"}},
+		Hash:         "whatever",
+	}
+	ioutil.WriteFile(b.DownloadFile, []byte("archive"), 0644)
+	b.saveManifest()
+
+	if err := LoadBuilds(dir); err != nil {
+		t.Fatalf("Expected no error loading builds, got %v", err)
+	}
+	if _, err := os.Stat(staleDir); !os.IsNotExist(err) {
+		t.Error("Expected build with unknown feature to be deleted")
+	}
+}
+
+func TestLoadBuildsChangedSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldBuilder := DefaultBuilder
+	defer func() { DefaultBuilder = oldBuilder }()
+
+	oldDir := filepath.Join(dir, "old")
+	os.Mkdir(oldDir, 0755)
+	orderedFeatures, err := features.Current().Resolve(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Build{
+		ID:           "oldid",
+		DownloadFile: filepath.Join(oldDir, "caddy.zip"),
+		GoOS:         "windows",
+		GoArch:       "amd64",
+		Features:     orderedFeatures,
+		Hash:         buildHash("windows", "amd64", "", buildFeatures("", orderedFeatures)),
+		sources:      "rev1",
+	}
+	ioutil.WriteFile(b.DownloadFile, []byte("archive"), 0644)
+	b.saveManifest()
+
+	// the checkouts were updated while the server was down
+	DefaultBuilder = sourcesBuilder{src: "rev2"}
+	if err := LoadBuilds(dir); err != nil {
+		t.Fatalf("Expected no error loading builds, got %v", err)
+	}
+	defer deleteBuildJob(b.Hash)
+	buildsMutex.Lock()
+	_, ok := jobs[b.ID]
+	buildsMutex.Unlock()
+	if ok {
+		t.Error("Expected build from old sources not to be loaded, but it was")
+	}
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Error("Expected build from old sources to be deleted")
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// MetricsPath is the path at which MetricsHandler is
+// expected to be mounted.
+const MetricsPath = "/metrics"
+
+// The metrics of the build server. Gauges, like the
+// queue depth, are read when metrics are requested.
+var (
+	buildsTotal = newCounter("buildsrv_builds_total",
+		"Build jobs that finished, by outcome.", "outcome")
+	buildDuration = newHistogram("buildsrv_build_duration_seconds",
+		"How long build jobs took, by target platform.",
+		[]float64{5, 10, 20, 30, 45, 60, 90, 120, 180, 300, 600}, "goos", "goarch")
+	buildRequests = newCounter("buildsrv_build_requests_total",
+		"Build requests, by whether the build was in the cache (hit) or had to be made (miss).", "cache")
+	pluginSelections = newCounter("buildsrv_plugin_selections_total",
+		"Build requests that selected a plugin, by plugin.", "plugin")
+	servedBytes = newCounter("buildsrv_served_bytes_total",
+		"Bytes of builds and their files sent to clients.")
+)
+
+// MetricsHandler serves the metrics of the build server
+// in the Prometheus text format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	buildsTotal.writeTo(w)
+	buildDuration.writeTo(w)
+	buildRequests.writeTo(w)
+	pluginSelections.writeTo(w)
+	servedBytes.writeTo(w)
+
+	buildsMutex.Lock()
+	cached := len(builds)
+	buildsMutex.Unlock()
+	writeGauge(w, "buildsrv_queue_depth", "Build jobs waiting for a worker.", float64(queue.len()))
+	writeGauge(w, "buildsrv_builds_cached", "Builds that are done or in progress.", float64(cached))
+	writeGauge(w, "buildsrv_disk_usage_bytes", "Size of the files of the builds.", float64(cacheSize()))
+}
+
+// recordBuildRequest counts a request for a build of
+// plugins, which was in the cache unless created.
+func recordBuildRequest(plugins features.Plugins, created bool) {
+	if created {
+		buildRequests.inc("miss")
+	} else {
+		buildRequests.inc("hit")
+	}
+	for _, plugin := range plugins {
+		if plugin.Name != "" {
+			pluginSelections.inc(plugin.Name)
+		}
+	}
+}
+
+// recordBuild counts a finished build job of b that failed
+// if err is not nil. If it started, it took duration.
+func recordBuild(b *Build, started bool, duration time.Duration, err error) {
+	if err != nil {
+		buildsTotal.inc(string(JobFailed))
+	} else {
+		buildsTotal.inc(string(JobSucceeded))
+	}
+	if started {
+		buildDuration.observe(duration.Seconds(), b.GoOS, b.GoArch)
+	}
+}
+
+// cacheSize returns the total size of the files of the
+// builds in the cache, as tracked for eviction, so it costs
+// nothing like walking BuildPath.
+func cacheSize() int64 {
+	buildsMutex.Lock()
+	defer buildsMutex.Unlock()
+	var size int64
+	for _, b := range builds {
+		b.mu.Lock()
+		size += b.size
+		b.mu.Unlock()
+	}
+	return size
+}
+
+// countingWriter counts the bytes of responses in servedBytes.
+type countingWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	servedBytes.add(float64(n))
+	return n, err
+}
+
+// ReadFrom lets files be sent with sendfile
+// when the underlying writer can do that.
+func (w countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	rf, ok := w.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{w}, r)
+	}
+	n, err := rf.ReadFrom(r)
+	servedBytes.add(float64(n))
+	return n, err
+}
+
+// counter is a metric whose values only go up, one
+// for each combination of the values of its labels.
+type counter struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // by label values, joined by "\xff"
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// inc adds 1 to the value of c for the label values.
+func (c *counter) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+// add adds v to the value of c for the label values.
+func (c *counter) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatValue(c.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labelPairs(c.labels, key, ""), formatValue(c.values[key]))
+	}
+}
+
+// histogram is a metric that counts observations in
+// buckets, for each combination of its label values.
+type histogram struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries // by label values, as in counter
+}
+
+type histogramSeries struct {
+	counts []uint64 // by bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogramSeries)}
+}
+
+// observe records v for the label values.
+func (h *histogram) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			le := `le="` + formatValue(upper) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelPairs(h.labels, key, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelPairs(h.labels, key, ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelPairs(h.labels, key, ""), s.count)
+	}
+}
+
+// writeGauge writes a gauge without labels whose value is v.
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatValue(v))
+}
+
+// labelPairs returns the labels of a series, like {a="1",b="2"},
+// from the label names and the key of their values. The pair
+// extra, if not empty, is added at the end.
+func labelPairs(names []string, key, extra string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(v)+`"`)
+			}
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatValue formats v the way Prometheus expects.
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
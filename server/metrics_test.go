@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "Test.", []float64{1, 5}, "goos")
+	for _, v := range []float64{0.5, 3, 4, 10} {
+		h.observe(v, "linux")
+	}
+	h.observe(2, `we"ird`)
+
+	var buf bytes.Buffer
+	h.writeTo(&buf)
+	expected := `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{goos="linux",le="1"} 1
+test_seconds_bucket{goos="linux",le="5"} 3
+test_seconds_bucket{goos="linux",le="+Inf"} 4
+test_seconds_sum{goos="linux"} 17.5
+test_seconds_count{goos="linux"} 4
+test_seconds_bucket{goos="we\"ird",le="1"} 0
+test_seconds_bucket{goos="we\"ird",le="5"} 1
+test_seconds_bucket{goos="we\"ird",le="+Inf"} 1
+test_seconds_sum{goos="we\"ird"} 2
+test_seconds_count{goos="we\"ird"} 1
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer useFakeBuilds(t)()
+
+	series := []string{
+		`buildsrv_builds_total{outcome="succeeded"}`,
+		`buildsrv_build_duration_seconds_count{goos="linux",goarch="amd64"}`,
+		`buildsrv_build_requests_total{cache="miss"}`,
+		`buildsrv_build_requests_total{cache="hit"}`,
+		`buildsrv_served_bytes_total`,
+	}
+	before := scrapeMetrics(t)
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, httptest.NewRequest("GET", "/download/build?os=linux&arch=amd64", nil))
+		if rec.Code != 200 {
+			t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	buildsMutex.Lock()
+	var hashes []string
+	for hash := range builds {
+		hashes = append(hashes, hash)
+	}
+	buildsMutex.Unlock()
+	defer func() {
+		for _, hash := range hashes {
+			deleteBuildJob(hash)
+		}
+	}()
+
+	after := scrapeMetrics(t)
+	for i, test := range []struct {
+		series   string
+		expected float64 // increase; 0 means any
+	}{
+		{series[0], 1},
+		{series[1], 1},
+		{series[2], 1},
+		{series[3], 1},
+		{series[4], 0},
+	} {
+		increase := after[test.series] - before[test.series]
+		if test.expected != 0 && increase != test.expected {
+			t.Errorf("Test %d: Expected %s to go up by %v, got %v", i, test.series, test.expected, increase)
+		}
+		if test.expected == 0 && increase <= 0 {
+			t.Errorf("Test %d: Expected %s to go up, got %v", i, test.series, increase)
+		}
+	}
+	for _, gauge := range []string{"buildsrv_queue_depth", "buildsrv_builds_cached", "buildsrv_disk_usage_bytes"} {
+		if _, ok := after[gauge]; !ok {
+			t.Errorf("Expected gauge %s, but it wasn't there", gauge)
+		}
+	}
+	if after["buildsrv_disk_usage_bytes"] <= 0 {
+		t.Errorf("Expected disk usage of the build, got %v", after["buildsrv_disk_usage_bytes"])
+	}
+}
+
+// scrapeMetrics returns the values of the series from
+// MetricsHandler by name and labels.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	rec := httptest.NewRecorder()
+	MetricsHandler(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	values := make(map[string]float64)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Expected a value in line %q, got %v", line, err)
+		}
+		values[line[:i]] = v
+	}
+	return values
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// DefaultCaddyMain is the package with Caddy's Run function.
+const DefaultCaddyMain = MainCaddyPackage + "/caddy/caddymain"
+
+// ModuleBuilder builds with Go modules instead of GOPATH. For
+// each build, it generates a temporary module with a main
+// package that imports Caddy and the plugins, and a go.mod
+// that pins the required module versions, then builds it
+// with GOFLAGS=-mod=mod so missing requirements are resolved
+// through GoProxy.
+type ModuleBuilder struct {
+	// GoProxy is the GOPROXY to get modules from. A local
+	// file-based proxy ("file:///path/to/proxy") works offline.
+	// If empty, the environment's GOPROXY is used.
+	GoProxy string `json:"goproxy,omitempty"`
+
+	// GoSumDB is the GOSUMDB to verify modules with. Set
+	// to "off" for modules that aren't public, like when
+	// using a local proxy. If empty, the environment's
+	// GOSUMDB is used.
+	GoSumDB string `json:"gosumdb,omitempty"`
+
+	// CaddyMain is the package with Caddy's Run function;
+	// DefaultCaddyMain if empty.
+	CaddyMain string `json:"caddy_main,omitempty"`
+
+	// Requires pins module versions, by module path. Caddy's
+	// module and the modules of all plugins must be listed,
+	// with exact versions (or pseudo-versions), so that a
+	// build hash always stands for the same sources.
+	Requires map[string]string `json:"requires,omitempty"`
+
+	// Env is added to the environment of the go command,
+	// for example to set GOMODCACHE.
+	Env []string `json:"env,omitempty"`
+}
+
+// LoadModuleBuilder reads the configuration of a
+// ModuleBuilder from the JSON file at path. Every
+// plugin in the current registry, and Caddy, must be
+// in a module that is pinned in Requires.
+func LoadModuleBuilder(path string) (ModuleBuilder, error) {
+	var m ModuleBuilder
+	f, err := os.Open(path)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&m)
+	if err != nil {
+		return m, fmt.Errorf("%s: %v", path, err)
+	}
+	for modPath, version := range m.Requires {
+		if !moduleVersion.MatchString(version) {
+			return m, fmt.Errorf("%s: %s: version '%s' is not exact, like v1.2.3", path, modPath, version)
+		}
+	}
+	err = m.checkPinned(append([]string{m.caddyMain()}, features.Current().Packages()...))
+	if err != nil {
+		return m, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// moduleVersion matches exact module versions, including
+// pseudo-versions. Queries like "latest" or branch names
+// resolve to different sources over time.
+var moduleVersion = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+// sources implements sourcer with the modules that are
+// pinned; the versions chosen for target are in its hash.
+func (m ModuleBuilder) sources(target Target) string {
+	return sourcesDigest([]string{m.caddyMain(), m.requireBlock()})
+}
+
+// caddyMain returns the package with Caddy's Run function.
+func (m ModuleBuilder) caddyMain() string {
+	if m.CaddyMain == "" {
+		return DefaultCaddyMain
+	}
+	return m.CaddyMain
+}
+
+// checkPinned returns an error naming the packages that
+// aren't in any module in Requires.
+func (m ModuleBuilder) checkPinned(packages []string) error {
+	var unpinned []string
+	for _, pkg := range packages {
+		if pkg != "" && m.module(pkg) == "" {
+			unpinned = append(unpinned, pkg)
+		}
+	}
+	if len(unpinned) > 0 {
+		return fmt.Errorf("no module pinned in requires for %s", strings.Join(unpinned, ", "))
+	}
+	return nil
+}
+
+// module returns the module in Requires that
+// provides the package pkg, or "" if none does.
+func (m ModuleBuilder) module(pkg string) string {
+	var module string
+	for path := range m.Requires {
+		if (pkg == path || strings.HasPrefix(pkg, path+"/")) && len(path) > len(module) {
+			module = path
+		}
+	}
+	return module
+}
+
+// queries returns the module queries for the versions chosen
+// for target, which override Requires, and the packages of
+// target that have no version chosen.
+func (m ModuleBuilder) queries(target Target) (pinned, packages []string) {
+	if target.CaddyVersion != "" {
+		pinned = append(pinned, MainCaddyPackage+"@"+target.CaddyVersion)
+	} else {
+		packages = append(packages, m.caddyMain())
+	}
+	for _, plugin := range target.Plugins {
+		if plugin.Version != "" {
+			pinned = append(pinned, plugin.Import+"@"+plugin.Version)
+		} else {
+			packages = append(packages, plugin.Import)
+		}
+	}
+	return pinned, packages
+}
+
+// check implements checker: the versions chosen for target
+// must be exact, and the packages without one must be pinned
+// in Requires, since the registry may have changed.
+func (m ModuleBuilder) check(target Target) error {
+	pinned, packages := m.queries(target)
+	for _, query := range pinned {
+		if version := query[strings.LastIndex(query, "@")+1:]; !moduleVersion.MatchString(version) {
+			return fmt.Errorf("%s: version is not exact, like v1.2.3", query)
+		}
+	}
+	return m.checkPinned(packages)
+}
+
+// Build implements Builder.
+func (m ModuleBuilder) Build(target Target, outputFile string, log io.Writer) error {
+	err := m.check(target)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "buildsrv_module")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	outputFile, err = filepath.Abs(outputFile)
+	if err != nil {
+		return err
+	}
+
+	err = m.writeModule(dir, target)
+	if err != nil {
+		return err
+	}
+
+	env := m.env(target)
+	pinned, _ := m.queries(target)
+	for _, query := range pinned {
+		fmt.Fprintf(log, "go get %s\n", query)
+		cmd := exec.Command("go", "get", query)
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stdout = log
+		cmd.Stderr = log
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("go get %s: %v", query, err)
+		}
+	}
+
+	cmd := exec.Command("go", "build", "-o", outputFile, ".")
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = log
+	cmd.Stderr = log
+
+	fmt.Fprintf(log, "go build in module with requirements:\n%s", m.requireBlock())
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("go build: %v", err)
+	}
+	return nil
+}
+
+// env returns the environment of the go
+// commands that build target.
+func (m ModuleBuilder) env(target Target) []string {
+	env := append(os.Environ(),
+		"GO111MODULE=on",
+		"GOFLAGS=-mod=mod",
+		"GOOS="+target.GoOS,
+		"GOARCH="+target.GoArch,
+	)
+	if goARM := target.goARM(); goARM != "" {
+		env = append(env, "GOARM="+goARM)
+	}
+	switch {
+	case target.CGO:
+		// the go command disables cgo when cross-compiling
+		env = append(env, "CGO_ENABLED=1")
+	case target.Static:
+		// otherwise, the go command enables cgo if it can
+		env = append(env, "CGO_ENABLED=0")
+	}
+	if m.GoProxy != "" {
+		env = append(env, "GOPROXY="+m.GoProxy)
+	}
+	if m.GoSumDB != "" {
+		env = append(env, "GOSUMDB="+m.GoSumDB)
+	}
+	return append(env, m.Env...)
+}
+
+// writeModule writes the main package and go.mod
+// of the module that builds target into dir.
+func (m ModuleBuilder) writeModule(dir string, target Target) error {
+	var mainGo bytes.Buffer
+	err := mainTemplate.Execute(&mainGo, struct {
+		CaddyMain string
+		Imports   []string
+	}{m.caddyMain(), target.Plugins.Packages()})
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "main.go"), mainGo.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+
+	goMod := "module caddy\n\n" + m.requireBlock()
+	return ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod), 0644)
+}
+
+// requireBlock returns the require directive of go.mod
+// with the pinned versions, in a consistent order.
+func (m ModuleBuilder) requireBlock() string {
+	if len(m.Requires) == 0 {
+		return ""
+	}
+	var paths []string
+	for path := range m.Requires {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var lines []string
+	for _, path := range paths {
+		lines = append(lines, "\t"+path+" "+m.Requires[path]+"\n")
+	}
+	return "require (\n" + strings.Join(lines, "") + ")\n"
+}
+
+var mainTemplate = template.Must(template.New("main").Parse(`// Code generated by buildsrv. DO NOT EDIT.
+
+package main
+
+import (
+	caddymain "{{.CaddyMain}}"
+{{range .Imports}}
+	_ "{{.}}"
+{{- end}}
+)
+
+func main() {
+	caddymain.Run()
+}
+`))
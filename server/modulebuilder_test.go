@@ -0,0 +1,217 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/buildsrv/features"
+)
+
+// writeProxyModule adds a module to the file-based
+// GOPROXY in dir, with the given files in it.
+func writeProxyModule(t *testing.T, dir, path, version string, files map[string]string) {
+	vdir := filepath.Join(dir, path, "@v")
+	err := os.MkdirAll(vdir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goMod := "module " + path + "\n"
+	ioutil.WriteFile(filepath.Join(vdir, "list"), []byte(version+"\n"), 0644)
+	ioutil.WriteFile(filepath.Join(vdir, version+".info"), []byte(`{"Version":"`+version+`"}`), 0644)
+	ioutil.WriteFile(filepath.Join(vdir, version+".mod"), []byte(goMod), 0644)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files["go.mod"] = goMod
+	for name, contents := range files {
+		w, err := zw.Create(path + "@" + version + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(contents))
+	}
+	zw.Close()
+	ioutil.WriteFile(filepath.Join(vdir, version+".zip"), buf.Bytes(), 0644)
+}
+
+func TestModuleBuilder(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs the go command")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go command not found")
+	}
+
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		exec.Command("chmod", "-R", "u+w", dir).Run() // the module cache is read-only
+		os.RemoveAll(dir)
+	}()
+
+	proxy := filepath.Join(dir, "proxy")
+	writeProxyModule(t, proxy, "example.com/caddy", "v1.0.0", map[string]string{
+		"caddy/caddymain/run.go": "package caddymain\n\nfunc Run() { println(\"caddy\") }\n",
+	})
+	writeProxyModule(t, proxy, "example.com/plugin", "v1.2.0", map[string]string{
+		"plugin.go": "package plugin\n\nfunc init() { println(\"plugin\") }\n",
+	})
+
+	builder := ModuleBuilder{
+		GoProxy:   "file://" + filepath.ToSlash(proxy),
+		GoSumDB:   "off",
+		CaddyMain: "example.com/caddy/caddy/caddymain",
+		Requires: map[string]string{
+			"example.com/caddy":  "v1.0.0",
+			"example.com/plugin": "v1.2.0",
+		},
+		Env: []string{
+			"GOMODCACHE=" + filepath.Join(dir, "modcache"),
+			"GOTOOLCHAIN=local",
+		},
+	}
+	target := Target{
+		GoOS:    "linux",
+		GoArch:  "amd64",
+		Plugins: features.Plugins{{Name: "plugin", Import: "example.com/plugin"}},
+	}
+
+	var log bytes.Buffer
+	outputFile := filepath.Join(dir, "out", "caddy")
+	os.Mkdir(filepath.Dir(outputFile), 0755)
+	err = builder.Build(target, outputFile, &log)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v; output:\n%s", err, log.String())
+	}
+	if _, err := os.Stat(outputFile); err != nil {
+		t.Errorf("Expected binary at %s, but: %v", outputFile, err)
+	}
+	if !strings.Contains(log.String(), "example.com/plugin v1.2.0") {
+		t.Errorf("Expected pinned requirements in log, got:\n%s", log.String())
+	}
+}
+
+func TestModuleBuilderMainPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	builder := ModuleBuilder{Requires: map[string]string{"b.com/b": "v0.1.0", "a.com/a": "v1.0.0"}}
+	target := Target{Plugins: features.Plugins{{Import: "a.com/a/plugin"}, {Import: "b.com/b"}}}
+	err = builder.writeModule(dir, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mainGo, _ := ioutil.ReadFile(filepath.Join(dir, "main.go"))
+	for _, expected := range []string{
+		`caddymain "` + DefaultCaddyMain + `"`,
+		`_ "a.com/a/plugin"`,
+		`_ "b.com/b"`,
+		"caddymain.Run()",
+	} {
+		if !strings.Contains(string(mainGo), expected) {
+			t.Errorf("Expected main.go to contain %s, got:\n%s", expected, mainGo)
+		}
+	}
+
+	goMod, _ := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	expected := "module caddy\n\nrequire (\n\ta.com/a v1.0.0\n\tb.com/b v0.1.0\n)\n"
+	if string(goMod) != expected {
+		t.Errorf("Expected go.mod:\n%s\ngot:\n%s", expected, goMod)
+	}
+}
+
+func TestLoadModuleBuilder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldRegistry := features.Current()
+	features.Set(features.Plugins{
+		{Name: "HTTP", Import: "example.com/caddy/caddyhttp"},
+		{Name: "plugin", Import: "example.com/plugin/sub"},
+	})
+	defer features.Set(oldRegistry)
+
+	path := filepath.Join(dir, "modules.json")
+	for i, test := range []struct {
+		config      string
+		expectInErr string
+	}{
+		{`{"caddy_main": "example.com/caddy/main", "requires": {"example.com/caddy": "v1.0.0", "example.com/plugin": "v0.0.0-20190101000000-0123456789ab"}}`, ""},
+		{`{"caddy_main": "example.com/caddy/main", "require": {}}`, `"require"`},
+		{`{"caddy_main": "example.com/caddy/main", "requires": {"example.com/caddy": "v1.0.0", "example.com/plugin": "latest"}}`, "not exact"},
+		{`{"caddy_main": "example.com/caddy/main", "requires": {"example.com/caddy": "v1.0.0", "example.com/plugin": "master"}}`, "not exact"},
+		{`{"caddy_main": "example.com/caddy/main", "requires": {"example.com/caddy": "v1.0.0"}}`, "example.com/plugin/sub"},
+		{`{"requires": {"example.com/caddy": "v1.0.0", "example.com/plugin": "v1.2.0"}}`, DefaultCaddyMain},
+	} {
+		ioutil.WriteFile(path, []byte(test.config), 0644)
+		_, err := LoadModuleBuilder(path)
+		if test.expectInErr == "" {
+			if err != nil {
+				t.Errorf("Test %d: Expected no error, got %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expectInErr) {
+			t.Errorf("Test %d: Expected error containing '%s', got %v", i, test.expectInErr, err)
+		}
+	}
+}
+
+func TestModuleBuilderUnpinned(t *testing.T) {
+	builder := ModuleBuilder{
+		CaddyMain: "example.com/caddy/main",
+		Requires:  map[string]string{"example.com/caddy": "v1.0.0"},
+	}
+	for i, test := range []struct {
+		target      Target
+		expectInErr string
+	}{
+		{Target{Plugins: features.Plugins{{Import: "example.com/new"}}}, "example.com/new"},
+		{Target{Plugins: features.Plugins{{Import: "example.com/new", Version: "master"}}}, "not exact"},
+		{Target{CaddyVersion: "latest"}, "not exact"},
+	} {
+		var log bytes.Buffer
+		err := builder.Build(test.target, filepath.Join(os.TempDir(), "caddy"), &log)
+		if err == nil || !strings.Contains(err.Error(), test.expectInErr) {
+			t.Errorf("Test %d: Expected error containing '%s', got %v", i, test.expectInErr, err)
+		}
+	}
+}
+
+func TestModuleBuilderCGO(t *testing.T) {
+	for i, test := range []struct {
+		target   Target
+		expected string
+	}{
+		{Target{GoOS: "darwin", GoArch: "amd64", CGO: true}, "CGO_ENABLED=1"},
+		{Target{GoOS: "linux", GoArch: "amd64", Static: true}, "CGO_ENABLED=0"},
+		{Target{GoOS: "linux", GoArch: "amd64"}, ""},
+	} {
+		var actual string
+		for _, v := range (ModuleBuilder{}).env(test.target) {
+			if strings.HasPrefix(v, "CGO_ENABLED=") {
+				actual = v
+			}
+		}
+		if test.expected == "" && os.Getenv("CGO_ENABLED") != "" {
+			continue // inherited
+		}
+		if actual != test.expected {
+			t.Errorf("Test %d: Expected '%s', got '%s'", i, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// CABundle is the file of CA certificates that goes into
+// container images of builds, so Caddy can make TLS connections
+// (to the ACME CA, for one) from a scratch image. If empty, the
+// first of caBundlePaths that exists is used.
+var CABundle string
+
+// caBundlePaths are where Linux distributions usually keep
+// their bundle of CA certificates.
+var caBundlePaths = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Alpine
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS
+}
+
+// imageCABundle is where the CA bundle is put in container images.
+const imageCABundle = "/etc/ssl/certs/ca-certificates.crt"
+
+// Media types of the parts of an OCI image.
+const (
+	ociImageIndex    = "application/vnd.oci.image.index.v1+json"
+	ociImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociImageConfig   = "application/vnd.oci.image.config.v1+json"
+	ociImageLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// ociDescriptor points to a blob in an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// checkImagePlatform returns an error if container images
+// can't be made of builds for goOS and goArch. Images have
+// no base, so the binary has to be static.
+func checkImagePlatform(goOS, goArch string) error {
+	if goOS != "linux" {
+		return fmt.Errorf("container images are only made for linux, not %s", goOS)
+	}
+	if pl, ok := allowed.get(goOS, goArch); ok && !pl.Static {
+		return fmt.Errorf("container images are not made for %s/%s since its builds are not static", goOS, goArch)
+	}
+	return nil
+}
+
+// imagePlatform returns the platform of the container images of b.
+func (b *Build) imagePlatform() *ociPlatform {
+	p := &ociPlatform{Architecture: b.GoArch, OS: b.GoOS}
+	if b.GoArch == "arm" {
+		p.Variant = "v" + b.GoARM
+		if b.GoARM == "" {
+			p.Variant = fmt.Sprint("v", defaultARM)
+		}
+	}
+	return p
+}
+
+// imageTag returns the tag that the container image of b
+// is loaded as.
+func (b *Build) imageTag() string {
+	if b.CaddyVersion != "" {
+		return b.CaddyVersion + "-custom"
+	}
+	return "custom"
+}
+
+// writeImage writes a container image of b to dest, as a tarball
+// of an OCI image layout. The image has one layer with the binary
+// and a CA bundle, on no base. The tarball also has a manifest.json
+// so older versions of docker load can read it.
+func (b *Build) writeImage(dest string) error {
+	err := checkImagePlatform(b.GoOS, b.GoArch)
+	if err != nil {
+		return err
+	}
+	binary, err := ioutil.ReadFile(b.OutputFile)
+	if err != nil {
+		return err
+	}
+	caBundle, err := readCABundle()
+	if err != nil {
+		return err
+	}
+	mtime := b.Created
+
+	layer, diffID, err := imageLayer(mtime, []pkgFile{
+		{Path: "/caddy", Mode: 0755, Data: binary},
+		{Path: imageCABundle, Mode: 0644, Data: caBundle},
+	})
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{
+		"org.opencontainers.image.title":       pkgName,
+		"org.opencontainers.image.description": b.packageDescription(),
+		"org.opencontainers.image.created":     mtime.UTC().Format(time.RFC3339),
+		"org.opencontainers.image.url":         "https://caddyserver.com",
+	}
+	if b.CaddyVersion != "" {
+		labels["org.opencontainers.image.version"] = b.CaddyVersion
+	}
+	platform := b.imagePlatform()
+	imageConfig := map[string]interface{}{
+		"created":      mtime.UTC(),
+		"architecture": platform.Architecture,
+		"os":           platform.OS,
+		"config": map[string]interface{}{
+			"Entrypoint":   []string{"/caddy"},
+			"Cmd":          []string{"-agree", "-root", "/srv"},
+			"Env":          []string{"CADDYPATH=/data", "SSL_CERT_FILE=" + imageCABundle},
+			"WorkingDir":   "/srv",
+			"ExposedPorts": map[string]struct{}{"80/tcp": {}, "443/tcp": {}, "2015/tcp": {}},
+			"Labels":       labels,
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{diffID},
+		},
+		"history": []map[string]interface{}{
+			{"created": mtime.UTC(), "created_by": "buildsrv " + b.Hash},
+		},
+	}
+	if platform.Variant != "" {
+		imageConfig["variant"] = platform.Variant
+	}
+	config, err := json.Marshal(imageConfig)
+	if err != nil {
+		return err
+	}
+
+	blobs := make(map[string][]byte)
+	addBlob := func(mediaType string, data []byte) ociDescriptor {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+		blobs[digest] = data
+		return ociDescriptor{MediaType: mediaType, Digest: digest, Size: int64(len(data))}
+	}
+	configDesc := addBlob(ociImageConfig, config)
+	layerDesc := addBlob(ociImageLayer, layer)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociImageManifest,
+		"config":        configDesc,
+		"layers":        []ociDescriptor{layerDesc},
+		"annotations":   labels,
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc := addBlob(ociImageManifest, manifest)
+	manifestDesc.Platform = platform
+	manifestDesc.Annotations = map[string]string{
+		"org.opencontainers.image.ref.name": b.imageTag(),
+		"io.containerd.image.name":          pkgName + ":" + b.imageTag(),
+	}
+
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociImageIndex,
+		"manifests":     []ociDescriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	dockerManifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   blobPath(configDesc.Digest),
+		"RepoTags": []string{pkgName + ":" + b.imageTag()},
+		"Layers":   []string{blobPath(layerDesc.Digest)},
+	}})
+	if err != nil {
+		return err
+	}
+
+	files := []pkgFile{
+		{Path: "oci-layout", Mode: 0644, Data: []byte(`{"imageLayoutVersion":"1.0.0"}`)},
+		{Path: "index.json", Mode: 0644, Data: index},
+		{Path: "manifest.json", Mode: 0644, Data: dockerManifest},
+	}
+	for _, desc := range []ociDescriptor{configDesc, layerDesc, manifestDesc} {
+		files = append(files, pkgFile{Path: blobPath(desc.Digest), Mode: 0644, Data: blobs[desc.Digest]})
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	for _, dir := range []string{"blobs/", "blobs/sha256/"} {
+		err = tw.WriteHeader(&tar.Header{Name: dir, Mode: 0755, ModTime: mtime, Typeflag: tar.TypeDir})
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		err = tw.WriteHeader(&tar.Header{Name: f.Path, Mode: int64(f.Mode), Size: int64(len(f.Data)), ModTime: mtime})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(f.Data)
+		if err != nil {
+			return err
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// blobPath returns the path of the blob with the given
+// digest in an OCI image layout.
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// imageLayer returns a gzipped layer tarball of files, and
+// the digest of the tarball before it was gzipped. It has
+// the directories of the files and a /tmp, /srv and /data.
+func imageLayer(mtime time.Time, files []pkgFile) ([]byte, string, error) {
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	dirs := []struct {
+		name string
+		mode int64
+	}{
+		{"data/", 0755},
+		{"etc/", 0755},
+		{"etc/ssl/", 0755},
+		{"etc/ssl/certs/", 0755},
+		{"srv/", 0755},
+		{"tmp/", 01777},
+	}
+	for _, dir := range dirs {
+		err := tw.WriteHeader(&tar.Header{Name: dir.name, Mode: dir.mode, ModTime: mtime, Typeflag: tar.TypeDir})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	for _, f := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    strings.TrimPrefix(f.Path, "/"),
+			Mode:    int64(f.Mode.Perm()),
+			Size:    int64(len(f.Data)),
+			ModTime: mtime,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = tw.Write(f.Data)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(tarball.Bytes()))
+
+	var layer bytes.Buffer
+	gz := gzip.NewWriter(&layer)
+	_, err = gz.Write(tarball.Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return layer.Bytes(), diffID, nil
+}
+
+// readCABundle returns the contents of CABundle, or of the
+// first of caBundlePaths that exists if CABundle is empty.
+func readCABundle() ([]byte, error) {
+	if CABundle != "" {
+		return ioutil.ReadFile(CABundle)
+	}
+	for _, path := range caBundlePaths {
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, errors.New("no CA bundle found to put in container images")
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildHandlerImage(t *testing.T) {
+	defer useFakeBuilds(t)()
+	caBundle := filepath.Join(BuildPath, "ca.pem")
+	err := ioutil.WriteFile(caBundle, []byte("fake certificates"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCABundle := CABundle
+	CABundle = caBundle
+	defer func() { CABundle = oldCABundle }()
+
+	rec := httptest.NewRecorder()
+	BuildHandler(rec, httptest.NewRequest("GET", "/download/build?os=linux&arch=arm&arm=6&format=oci", nil))
+	if rec.Code != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); !strings.HasSuffix(disposition, `custom.oci.tar"`) {
+		t.Errorf("Expected .oci.tar download, got '%s'", disposition)
+	}
+	defer func() {
+		buildsMutex.Lock()
+		var hashes []string
+		for hash := range builds {
+			hashes = append(hashes, hash)
+		}
+		buildsMutex.Unlock()
+		for _, hash := range hashes {
+			deleteBuildJob(hash)
+		}
+	}()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(rec.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected valid tarball, got %v", err)
+		}
+		files[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+	if string(files["oci-layout"]) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Errorf("Expected oci-layout file, got %q", files["oci-layout"])
+	}
+
+	// each blob is where its digest says, and has that digest
+	blob := func(desc ociDescriptor, v interface{}) []byte {
+		data, ok := files[blobPath(desc.Digest)]
+		if !ok {
+			t.Fatalf("Expected blob %s, but it wasn't there", desc.Digest)
+		}
+		if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data)); digest != desc.Digest || int64(len(data)) != desc.Size {
+			t.Fatalf("Expected blob with digest %s and size %d, got %s and %d", desc.Digest, desc.Size, digest, len(data))
+		}
+		if v != nil {
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatalf("Expected JSON blob %s, got %v", desc.Digest, err)
+			}
+		}
+		return data
+	}
+
+	var index struct {
+		Manifests []ociDescriptor
+	}
+	if err := json.Unmarshal(files["index.json"], &index); err != nil || len(index.Manifests) != 1 {
+		t.Fatalf("Expected index with one manifest, got %s (error: %v)", files["index.json"], err)
+	}
+	if p := index.Manifests[0].Platform; p == nil || *p != (ociPlatform{Architecture: "arm", OS: "linux", Variant: "v6"}) {
+		t.Errorf("Expected linux/arm/v6 platform, got %+v", p)
+	}
+	if name := index.Manifests[0].Annotations["org.opencontainers.image.ref.name"]; name != "custom" {
+		t.Errorf("Expected image tag custom, got '%s'", name)
+	}
+	var manifest struct {
+		Config ociDescriptor
+		Layers []ociDescriptor
+	}
+	blob(index.Manifests[0], &manifest)
+	var config struct {
+		Config struct {
+			Entrypoint []string
+		}
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		}
+	}
+	blob(manifest.Config, &config)
+	if len(config.Config.Entrypoint) != 1 || config.Config.Entrypoint[0] != "/caddy" {
+		t.Errorf("Expected entrypoint /caddy, got %v", config.Config.Entrypoint)
+	}
+	if len(manifest.Layers) != 1 || len(config.RootFS.DiffIDs) != 1 {
+		t.Fatalf("Expected one layer, got %v and %v", manifest.Layers, config.RootFS.DiffIDs)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(blob(manifest.Layers[0], nil)))
+	if err != nil {
+		t.Fatalf("Expected gzipped layer, got %v", err)
+	}
+	layer, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("Expected gzipped layer, got %v", err)
+	}
+	if diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layer)); diffID != config.RootFS.DiffIDs[0] {
+		t.Errorf("Expected layer diff ID %s, got %s", config.RootFS.DiffIDs[0], diffID)
+	}
+	layerFiles := make(map[string]string)
+	tr = tar.NewReader(bytes.NewReader(layer))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected valid layer, got %v", err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		layerFiles[hdr.Name] = string(data)
+	}
+	if !strings.HasPrefix(layerFiles["caddy"], "fake caddy") {
+		t.Errorf("Expected binary at /caddy, got %q", layerFiles["caddy"])
+	}
+	if layerFiles["etc/ssl/certs/ca-certificates.crt"] != "fake certificates" {
+		t.Errorf("Expected CA bundle, got %q", layerFiles["etc/ssl/certs/ca-certificates.crt"])
+	}
+
+	// older docker load reads manifest.json
+	var dockerManifest []struct {
+		Config string
+		Layers []string
+	}
+	if err := json.Unmarshal(files["manifest.json"], &dockerManifest); err != nil || len(dockerManifest) != 1 {
+		t.Fatalf("Expected docker manifest, got %s (error: %v)", files["manifest.json"], err)
+	}
+	if dockerManifest[0].Config != blobPath(manifest.Config.Digest) {
+		t.Errorf("Expected docker manifest to point at config %s, got %s", blobPath(manifest.Config.Digest), dockerManifest[0].Config)
+	}
+}
+
+func TestReadCABundle(t *testing.T) {
+	oldCABundle, oldPaths := CABundle, caBundlePaths
+	defer func() { CABundle, caBundlePaths = oldCABundle, oldPaths }()
+
+	CABundle = ""
+	caBundlePaths = []string{filepath.Join(os.TempDir(), "buildsrv_no_such_bundle")}
+	if _, err := readCABundle(); err == nil {
+		t.Error("Expected error without a CA bundle, but didn't get one")
+	}
+}
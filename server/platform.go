@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// Platform is an operating system and architecture
+// that builds can be made for, and how to make them.
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+
+	// CGO is whether builds need cgo. At time of writing, building
+	// with CGO_ENABLED=0 for darwin can break stuff:
+	// https://www.reddit.com/r/golang/comments/46bd5h/ama_we_are_the_go_contributors_ask_us_anything/d03rmc9
+	CGO bool `json:"cgo,omitempty"`
+
+	// Static is whether builds can be statically linked,
+	// which makes them work on more systems.
+	Static bool `json:"static,omitempty"`
+
+	// Compression is the format that downloads are in unless
+	// the client asks for another, like "zip"; "tar.gz" if empty.
+	// It must be an archive format or "binary"; packages and
+	// images are only made when asked for.
+	Compression string `json:"compression,omitempty"`
+
+	// Exe is the extension of executables, like ".exe".
+	Exe string `json:"exe,omitempty"`
+}
+
+// defaultPlatform returns the platform for goOS and goArch
+// with the flags that work for most builds on it.
+func defaultPlatform(goOS, goArch string) Platform {
+	p := Platform{OS: goOS, Arch: goArch, Static: true}
+	switch goOS {
+	case "darwin":
+		p.CGO, p.Static = true, false
+		p.Compression = "zip"
+	case "windows":
+		p.Compression = "zip"
+		p.Exe = ".exe"
+	}
+	return p
+}
+
+// compression returns the compression constant of
+// p's archive format, like CompressTarGz.
+func (p Platform) compression() int {
+	if compression, ok := formats[p.Compression]; ok {
+		return compression
+	}
+	return CompressTarGz
+}
+
+// Platforms is a list of platforms.
+type Platforms []Platform
+
+// get returns the platform for goOS and goArch, if it is in p.
+func (p Platforms) get(goOS, goArch string) (Platform, bool) {
+	for _, pl := range p {
+		if pl.OS == goOS && pl.Arch == goArch {
+			return pl, true
+		}
+	}
+	return Platform{}, false
+}
+
+// valid returns whether builds can be made for goOS and goArch.
+func (p Platforms) valid(goOS, goArch string) bool {
+	_, ok := p.get(goOS, goArch)
+	return ok
+}
+
+// withDefaults returns the platforms for the os/arch combinations
+// in p with the flags from defaultPlatform.
+func (p Platforms) withDefaults() Platforms {
+	platforms := make(Platforms, len(p))
+	for i, pl := range p {
+		platforms[i] = defaultPlatform(pl.OS, pl.Arch)
+	}
+	return platforms
+}
+
+// PlatformConfig configures the platforms that builds can be made
+// for. The list starts out with the platforms of the Go toolchain,
+// if FromGo is set. Then the Exclude patterns are applied, and
+// Platforms are added, replacing any seeded platform with the same
+// os/arch.
+type PlatformConfig struct {
+	// FromGo is whether to seed the list with the platforms that
+	// "go tool dist list" reports, with the default flags.
+	FromGo bool `json:"from_go,omitempty"`
+
+	// Exclude are "os/arch" patterns (like "plan9/*") of
+	// seeded platforms to leave out.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Platforms are used as they are, flags and all.
+	Platforms Platforms `json:"platforms,omitempty"`
+}
+
+// LoadPlatforms reads a PlatformConfig as JSON from the file at
+// path and makes the platforms it describes the only ones that
+// builds can be made for. If there is any error, the platforms
+// are not changed. It must be called before the first request.
+func LoadPlatforms(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var config PlatformConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&config)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	var seed Platforms
+	if config.FromGo {
+		seed, err = goPlatforms()
+		if err != nil {
+			return fmt.Errorf("%s: listing platforms of the Go toolchain: %v", path, err)
+		}
+	}
+	platforms, err := config.platforms(seed)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	allowed = platforms
+	return nil
+}
+
+// platforms returns the platforms that config describes
+// when seeded with seed, and makes sure they are valid.
+func (config PlatformConfig) platforms(seed Platforms) (Platforms, error) {
+	for _, pattern := range config.Exclude {
+		_, err := path.Match(pattern, "os/arch")
+		if err != nil || strings.Count(pattern, "/") != 1 {
+			return nil, fmt.Errorf("bad platform pattern '%s'", pattern)
+		}
+	}
+
+	var platforms Platforms
+	for _, pl := range seed {
+		if config.excludes(pl) || config.Platforms.valid(pl.OS, pl.Arch) {
+			continue
+		}
+		platforms = append(platforms, pl)
+	}
+	seen := make(map[string]bool)
+	for _, pl := range config.Platforms {
+		name := pl.OS + "/" + pl.Arch
+		if pl.OS == "" || pl.Arch == "" {
+			return nil, fmt.Errorf("platform '%s': missing os or arch", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("platform '%s': duplicate", name)
+		}
+		seen[name] = true
+		if compression, ok := formats[pl.Compression]; pl.Compression != "" && !ok {
+			return nil, fmt.Errorf("platform '%s': unknown compression '%s'", name, pl.Compression)
+		} else if !isArchive(compression) {
+			return nil, fmt.Errorf("platform '%s': compression '%s' is not an archive format", name, pl.Compression)
+		}
+		if pl.CGO && pl.Static {
+			return nil, fmt.Errorf("platform '%s': builds with cgo can't be static", name)
+		}
+		platforms = append(platforms, pl)
+	}
+	if len(platforms) == 0 {
+		return nil, errors.New("no platforms")
+	}
+	return platforms, nil
+}
+
+// excludes returns whether pl matches any of the Exclude patterns.
+func (config PlatformConfig) excludes(pl Platform) bool {
+	for _, pattern := range config.Exclude {
+		if matched, _ := path.Match(pattern, pl.OS+"/"+pl.Arch); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// goPlatforms returns the platforms that the Go toolchain can
+// build for, except the broken ones, with the default flags.
+func goPlatforms() (Platforms, error) {
+	out, err := exec.Command("go", "tool", "dist", "list", "-json").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseDistList(out)
+}
+
+// parseDistList parses the output of "go tool dist list -json".
+func parseDistList(data []byte) (Platforms, error) {
+	var list []struct {
+		GOOS   string
+		GOARCH string
+		Broken bool
+	}
+	err := json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	var platforms Platforms
+	for _, dist := range list {
+		if !dist.Broken {
+			platforms = append(platforms, defaultPlatform(dist.GOOS, dist.GOARCH))
+		}
+	}
+	return platforms, nil
+}
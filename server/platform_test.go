@@ -0,0 +1,145 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultPlatform(t *testing.T) {
+	for i, test := range []struct {
+		goOS, goArch string
+		expected     Platform
+	}{
+		{"linux", "amd64", Platform{OS: "linux", Arch: "amd64", Static: true}},
+		{"darwin", "amd64", Platform{OS: "darwin", Arch: "amd64", CGO: true, Compression: "zip"}},
+		{"windows", "386", Platform{OS: "windows", Arch: "386", Static: true, Compression: "zip", Exe: ".exe"}},
+	} {
+		if actual := defaultPlatform(test.goOS, test.goArch); actual != test.expected {
+			t.Errorf("Test %d: Expected %+v, got %+v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestParseDistList(t *testing.T) {
+	data := []byte(`[
+	{"GOOS": "linux", "GOARCH": "amd64", "CgoSupported": true, "FirstClass": true},
+	{"GOOS": "windows", "GOARCH": "arm", "CgoSupported": false, "FirstClass": false, "Broken": true},
+	{"GOOS": "darwin", "GOARCH": "arm64", "CgoSupported": true, "FirstClass": true}
+]`)
+	platforms, err := parseDistList(data)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := Platforms{defaultPlatform("linux", "amd64"), defaultPlatform("darwin", "arm64")}
+	if !reflect.DeepEqual(platforms, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, platforms)
+	}
+}
+
+func TestPlatformConfig(t *testing.T) {
+	seed := Platforms{{OS: "linux", Arch: "amd64"}, {OS: "plan9", Arch: "386"}, {OS: "plan9", Arch: "amd64"}}.withDefaults()
+
+	for i, test := range []struct {
+		config    PlatformConfig
+		expected  []string
+		shouldErr bool
+	}{
+		{PlatformConfig{}, []string{"linux/amd64", "plan9/386", "plan9/amd64"}, false},
+		{PlatformConfig{Exclude: []string{"*/*"}}, nil, true},
+		{PlatformConfig{Exclude: []string{"plan9/*"}}, []string{"linux/amd64"}, false},
+		{PlatformConfig{Exclude: []string{"plan9"}}, nil, true},
+		{PlatformConfig{Exclude: []string{"*/*"}, Platforms: Platforms{{OS: "linux", Arch: "mips64le"}}}, []string{"linux/mips64le"}, false},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux", Arch: "amd64", Compression: "zip"}}}, []string{"plan9/386", "plan9/amd64", "linux/amd64"}, false},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux"}}}, nil, true},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux", Arch: "arm"}, {OS: "linux", Arch: "arm"}}}, nil, true},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux", Arch: "arm", Compression: "rar"}}}, nil, true},
+		{PlatformConfig{Platforms: Platforms{{OS: "darwin", Arch: "amd64", Compression: "deb"}}}, nil, true},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux", Arch: "amd64", Compression: "oci"}}}, nil, true},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux", Arch: "amd64", Compression: "binary"}}}, []string{"plan9/386", "plan9/amd64", "linux/amd64"}, false},
+		{PlatformConfig{Platforms: Platforms{{OS: "linux", Arch: "arm", CGO: true, Static: true}}}, nil, true},
+	} {
+		platforms, err := test.config.platforms(seed)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: Expected error, but didn't get one", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Expected no error, but got %v", i, err)
+			continue
+		}
+		var actual []string
+		for _, pl := range platforms {
+			actual = append(actual, pl.OS+"/"+pl.Arch)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestLoadPlatforms(t *testing.T) {
+	oldAllowed := allowed
+	defer func() { allowed = oldAllowed }()
+
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "platforms.json")
+
+	err = ioutil.WriteFile(path, []byte(`{"platforms": [{"os": "linux", "arch": "mips64le", "static": true}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadPlatforms(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !allowed.valid("linux", "mips64le") || allowed.valid("linux", "amd64") {
+		t.Errorf("Expected only the configured platform to be allowed, got %+v", allowed)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`{"platforms": [], "nope": true}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadPlatforms(path); err == nil {
+		t.Error("Expected error for unknown field, but didn't get one")
+	}
+	if !allowed.valid("linux", "mips64le") {
+		t.Error("Expected platforms to be kept after an error")
+	}
+}
+
+func TestReserveBuildPlatform(t *testing.T) {
+	for i, test := range []struct {
+		goOS, goArch     string
+		expectedFilename string
+		expectedOutput   string
+	}{
+		{"linux", "amd64", "caddy_linux_amd64_custom.tar.gz", "caddy"},
+		{"windows", "amd64", "caddy_windows_amd64_custom.zip", "caddy.exe"},
+		{"darwin", "amd64", "caddy_darwin_amd64_custom.zip", "caddy"},
+	} {
+		b, created := reserveBuild(test.goOS, test.goArch, "", "", nil)
+		deleteBuildJob(b.Hash)
+		if !created {
+			t.Errorf("Test %d: Expected a new build", i)
+		}
+		if b.DownloadFilename != test.expectedFilename {
+			t.Errorf("Test %d: Expected download filename %s, got %s", i, test.expectedFilename, b.DownloadFilename)
+		}
+		if filepath.Base(b.OutputFile) != test.expectedOutput {
+			t.Errorf("Test %d: Expected output file %s, got %s", i, test.expectedOutput, filepath.Base(b.OutputFile))
+		}
+		if b.platform != defaultPlatform(test.goOS, test.goArch) {
+			t.Errorf("Test %d: Expected platform %+v, got %+v", i, defaultPlatform(test.goOS, test.goArch), b.platform)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// Workers is how many builds may run at the same time.
+	// It must be set before the first build is queued.
+	Workers = 2
+
+	// QueueSize is how many build jobs may wait for a worker.
+	// When the queue is full, new jobs are rejected.
+	QueueSize = 64
+
+	// queue is the queue of build jobs waiting for a worker.
+	queue = &buildQueue{}
+)
+
+// QueuePositionHeader is the response header with the
+// 1-based place in the queue of a job waiting for a worker.
+const QueuePositionHeader = "X-Queue-Position"
+
+// queueRetryAfter is the number of seconds clients are told
+// to wait before retrying when the queue is full.
+const queueRetryAfter = "60"
+
+// errQueueFull is returned when a job can't be queued
+// because too many jobs are already waiting.
+var errQueueFull = errors.New("too many builds queued; try again later")
+
+// errShuttingDown is returned when a job can't be queued,
+// or won't be run, because the build server is shutting down.
+var errShuttingDown = errors.New("build server is shutting down; try again later")
+
+// notQueued returns whether err is why a job was never
+// run, so the client should try again later.
+func notQueued(err error) bool {
+	return err == errQueueFull || err == errShuttingDown
+}
+
+// buildQueue is a FIFO queue of build jobs which are
+// performed by a fixed number of worker goroutines.
+type buildQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // signaled when a job is queued
+	idle    *sync.Cond // broadcast when a job is done
+	pending []*Build
+	running int  // jobs that workers are performing
+	closed  bool // no more jobs are taken
+	once    sync.Once
+}
+
+// enqueue adds b to the end of the queue. It returns
+// errQueueFull if QueueSize jobs are already waiting,
+// or errShuttingDown if the queue was closed. Anyone
+// interested in the result of the build can wait on
+// b.DoneChan.
+func (q *buildQueue) enqueue(b *Build) error {
+	q.once.Do(q.start)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errShuttingDown
+	}
+	if len(q.pending) >= QueueSize {
+		return errQueueFull
+	}
+	q.pending = append(q.pending, b)
+	q.cond.Signal()
+	return nil
+}
+
+// position returns the 1-based position of b in the queue,
+// or 0 if b is not waiting for a worker.
+func (q *buildQueue) position(b *Build) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, pb := range q.pending {
+		if pb == b {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// len returns the number of jobs waiting for a worker.
+func (q *buildQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// close stops q from taking new jobs and fails the jobs
+// that are waiting for a worker. Running jobs carry on.
+func (q *buildQueue) close() {
+	q.once.Do(q.start)
+
+	q.mu.Lock()
+	q.closed = true
+	pending := q.pending
+	q.pending = nil
+	q.mu.Unlock()
+
+	for _, b := range pending {
+		b.cancel(errShuttingDown)
+	}
+}
+
+// wait waits until no jobs are running, or until ctx is
+// done, whichever is first. It returns ctx.Err() if the
+// jobs didn't finish in time.
+func (q *buildQueue) wait(ctx context.Context) error {
+	q.once.Do(q.start)
+
+	done := make(chan struct{})
+	go func() {
+		q.mu.Lock()
+		for q.running > 0 {
+			q.idle.Wait()
+		}
+		q.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start starts the workers.
+func (q *buildQueue) start() {
+	q.cond = sync.NewCond(&q.mu)
+	q.idle = sync.NewCond(&q.mu)
+	for i := 0; i < Workers; i++ {
+		go q.work()
+	}
+}
+
+// work performs jobs from the queue, one at a time, forever.
+func (q *buildQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 {
+			q.cond.Wait()
+		}
+		b := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.running++
+		q.mu.Unlock()
+
+		b.run() // which logs how it went
+
+		q.mu.Lock()
+		q.running--
+		q.idle.Broadcast()
+		q.mu.Unlock()
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildQueue(t *testing.T) {
+	// A queue with no workers, so jobs stay put
+	q := &buildQueue{}
+	q.once.Do(func() { q.cond = sync.NewCond(&q.mu) })
+
+	oldSize := QueueSize
+	QueueSize = 2
+	defer func() { QueueSize = oldSize }()
+
+	b1, b2, b3 := &Build{ID: "1"}, &Build{ID: "2"}, &Build{ID: "3"}
+
+	if err := q.enqueue(b1); err != nil {
+		t.Fatalf("Expected no error queueing first job, got %v", err)
+	}
+	if err := q.enqueue(b2); err != nil {
+		t.Fatalf("Expected no error queueing second job, got %v", err)
+	}
+	if err := q.enqueue(b3); err != errQueueFull {
+		t.Errorf("Expected errQueueFull when queue is full, got %v", err)
+	}
+
+	if pos := q.position(b1); pos != 1 {
+		t.Errorf("Expected first job at position 1, got %d", pos)
+	}
+	if pos := q.position(b2); pos != 2 {
+		t.Errorf("Expected second job at position 2, got %d", pos)
+	}
+	if pos := q.position(b3); pos != 0 {
+		t.Errorf("Expected rejected job at position 0, got %d", pos)
+	}
+	if n := q.len(); n != 2 {
+		t.Errorf("Expected queue length 2, got %d", n)
+	}
+}
+
+// orderBuilder is a FakeBuilder that waits for release to
+// be closed, then records the OS of each build it makes.
+type orderBuilder struct {
+	release chan struct{}
+	mu      *sync.Mutex
+	order   *[]string
+}
+
+func (ob orderBuilder) Build(target Target, outputFile string, log io.Writer) error {
+	<-ob.release
+	ob.mu.Lock()
+	*ob.order = append(*ob.order, target.GoOS)
+	ob.mu.Unlock()
+	return FakeBuilder{}.Build(target, outputFile, log)
+}
+
+func TestBuildHandlerQueue(t *testing.T) {
+	defer useFakeBuilds(t)()
+	var order []string
+	release := make(chan struct{})
+	DefaultBuilder = orderBuilder{release, new(sync.Mutex), &order}
+
+	oldQueue, oldWorkers, oldSize := queue, Workers, QueueSize
+	queue, Workers, QueueSize = &buildQueue{}, 1, 2
+	defer func() { queue, Workers, QueueSize = oldQueue, oldWorkers, oldSize }()
+	defer func() {
+		buildsMutex.Lock()
+		var hashes []string
+		for hash := range builds {
+			hashes = append(hashes, hash)
+		}
+		buildsMutex.Unlock()
+		for _, hash := range hashes {
+			deleteBuildJob(hash)
+		}
+	}()
+
+	request := func(goOS string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/download/build?os="+goOS+"&arch=amd64", nil)
+		req.Header.Set("Prefer", "wait=10, respond-async")
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, req)
+		return rec
+	}
+
+	// the first job keeps the only worker busy, and
+	// the next ones wait in line for it, in order
+	var started []*Build
+	for i, goOS := range []string{"linux", "windows", "darwin"} {
+		rec := request(goOS)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Test %d: Expected status %d, got %d: %s", i, http.StatusAccepted, rec.Code, rec.Body.String())
+		}
+		var js jobStatus
+		if err := json.NewDecoder(rec.Body).Decode(&js); err != nil {
+			t.Fatalf("Test %d: Expected job status, got error: %v", i, err)
+		}
+		if loc := rec.Header().Get("Location"); loc != APIBuildsPath+"/"+js.ID {
+			t.Errorf("Test %d: Expected Location of the job, got '%s'", i, loc)
+		}
+		buildsMutex.Lock()
+		b := jobs[js.ID]
+		buildsMutex.Unlock()
+		started = append(started, b)
+		if i == 0 {
+			for b.State() != JobRunning {
+				time.Sleep(time.Millisecond)
+			}
+			continue
+		}
+		if pos := rec.Header().Get(QueuePositionHeader); pos != strconv.Itoa(i) || js.Position != i {
+			t.Errorf("Test %d: Expected queue position %d, got header '%s' and status %d", i, i, pos, js.Position)
+		}
+	}
+
+	// no more room in the queue
+	rec := request("freebsd")
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d when queue is full, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if ra := rec.Header().Get("Retry-After"); ra != queueRetryAfter {
+		t.Errorf("Expected Retry-After %s when queue is full, got '%s'", queueRetryAfter, ra)
+	}
+
+	close(release)
+	for _, b := range started {
+		<-b.DoneChan
+	}
+	expected := []string{"linux", "windows", "darwin"}
+	if len(order) != len(expected) {
+		t.Fatalf("Expected builds %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("Expected builds in order %v, got %v", expected, order)
+			break
+		}
+	}
+
+	// done builds are served right away, even to async clients
+	rec = request("linux")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d for a finished build, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestBuildHandlerQueueFull(t *testing.T) {
+	defer useFakeBuilds(t)()
+
+	// no room in the queue at all
+	oldQueue, oldWorkers, oldSize := queue, Workers, QueueSize
+	queue, Workers, QueueSize = &buildQueue{}, 1, 0
+	defer func() { queue, Workers, QueueSize = oldQueue, oldWorkers, oldSize }()
+
+	request := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/download/build?os=linux&arch=amd64", nil)
+		rec := httptest.NewRecorder()
+		BuildHandler(rec, req)
+		return rec
+	}
+	hits := func() float64 {
+		buildRequests.mu.Lock()
+		defer buildRequests.mu.Unlock()
+		return buildRequests.values["hit"]
+	}
+
+	// hold the queue so the first request has reserved
+	// the build but not yet found out the queue is full
+	queue.once.Do(queue.start)
+	queue.mu.Lock()
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- request() }()
+	var b *Build
+	for b == nil {
+		buildsMutex.Lock()
+		for _, job := range jobs {
+			if job.State() == JobQueued {
+				b = job
+			}
+		}
+		buildsMutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	// an identical request joins it in the meantime
+	joined := hits()
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- request() }()
+	for hits() == joined {
+		time.Sleep(time.Millisecond)
+	}
+	queue.mu.Unlock()
+
+	for i, ch := range []chan *httptest.ResponseRecorder{first, second} {
+		select {
+		case rec := <-ch:
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("Test %d: Expected status %d, got %d: %s", i, http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+			}
+			if ra := rec.Header().Get("Retry-After"); ra != queueRetryAfter {
+				t.Errorf("Test %d: Expected Retry-After %s, got '%s'", i, queueRetryAfter, ra)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Test %d: Expected a response, but the request is still waiting", i)
+		}
+	}
+
+	// the job can still be looked up, and its log ends
+	rec := httptest.NewRecorder()
+	BuildsAPIHandler(rec, httptest.NewRequest("GET", APIBuildsPath+"/"+b.ID, nil))
+	var js jobStatus
+	if err := json.NewDecoder(rec.Body).Decode(&js); err != nil {
+		t.Fatalf("Expected job status, got error: %v", err)
+	}
+	if js.State != JobFailed || js.Error != errQueueFull.Error() {
+		t.Errorf("Expected job to have failed with '%v', got %s: '%s'", errQueueFull, js.State, js.Error)
+	}
+	rec = httptest.NewRecorder()
+	BuildsAPIHandler(rec, httptest.NewRequest("GET", APIBuildsPath+"/"+b.ID+"/log", nil))
+	if !strings.Contains(rec.Body.String(), "event: end") {
+		t.Errorf("Expected the log stream to end, got:\n%s", rec.Body.String())
+	}
+
+	buildsMutex.Lock()
+	delete(jobs, b.ID)
+	buildsMutex.Unlock()
+}
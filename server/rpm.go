@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// RPM header tags; see rpmtag.h in the RPM sources.
+const (
+	rpmTagHeaderSignatures  = 62
+	rpmTagHeaderImmutable   = 63
+	rpmTagHeaderI18NTable   = 100
+	rpmSigTagSHA1           = 269
+	rpmSigTagSHA256         = 273
+	rpmSigTagSize           = 1000
+	rpmSigTagMD5            = 1004
+	rpmSigTagPayloadSize    = 1007
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagFileVerifyFlags   = 1045
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+	rpmTagPayloadDigest     = 5092
+	rpmTagPayloadDigestAlgo = 5093
+)
+
+// RPM header data types.
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// Flags of RPM files and dependencies.
+const (
+	rpmFileConfig     = 1 << 0
+	rpmFileDoc        = 1 << 1
+	rpmFileNoReplace  = 1 << 4
+	rpmSenseLess      = 1 << 1
+	rpmSenseEqual     = 1 << 3
+	rpmSenseRPMLib    = 1 << 24
+	rpmDigestSHA256   = 8
+	rpmRelease        = "1"
+	rpmRequireRPMLibs = rpmSenseRPMLib | rpmSenseLess | rpmSenseEqual
+)
+
+// writeRPM writes an RPM package of b to dest.
+func (b *Build) writeRPM(dest string) error {
+	arch, err := packageArch(rpmArch, b.GoOS, b.GoArch, b.GoARM)
+	if err != nil {
+		return err
+	}
+	files, err := b.packageFiles("/usr/lib/systemd/system")
+	if err != nil {
+		return err
+	}
+	version := b.packageVersion()
+	mtime := int32(b.Created.Unix())
+
+	// The payload is a cpio archive of the files
+	var cpio bytes.Buffer
+	var (
+		sizes, mtimes, inodes, devices, dirIndexes, flags, verifyFlags []int32
+		modes, rdevs                                                   []int16
+		digests, baseNames, dirNames, empties, roots                   []string
+		totalSize                                                      int32
+	)
+	dirIndex := make(map[string]int32)
+	for i, f := range files {
+		inode := int32(i + 1)
+		mode := int16(0100000 | f.Mode.Perm())
+		writeCPIOEntry(&cpio, "."+f.Path, uint32(inode), uint32(uint16(mode)), uint32(mtime), f.Data)
+
+		dir, base := path.Split(f.Path)
+		if _, ok := dirIndex[dir]; !ok {
+			dirIndex[dir] = int32(len(dirNames))
+			dirNames = append(dirNames, dir)
+		}
+		sum := sha256.Sum256(f.Data)
+		var flag int32
+		if f.Doc {
+			flag = rpmFileDoc
+		}
+		if f.Conf {
+			flag = rpmFileConfig | rpmFileNoReplace
+		}
+
+		sizes = append(sizes, int32(len(f.Data)))
+		mtimes = append(mtimes, mtime)
+		inodes = append(inodes, inode)
+		devices = append(devices, 1)
+		dirIndexes = append(dirIndexes, dirIndex[dir])
+		flags = append(flags, flag)
+		verifyFlags = append(verifyFlags, -1)
+		modes = append(modes, mode)
+		rdevs = append(rdevs, 0)
+		digests = append(digests, hex.EncodeToString(sum[:]))
+		baseNames = append(baseNames, base)
+		empties = append(empties, "")
+		roots = append(roots, "root")
+		totalSize += int32(len(f.Data))
+	}
+	writeCPIOEntry(&cpio, "TRAILER!!!", 0, 0, 0, nil)
+
+	var payload bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&payload, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	_, err = gz.Write(cpio.Bytes())
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	payloadDigest := sha256.Sum256(payload.Bytes())
+
+	requireNames := []string{"rpmlib(CompressedFileNames)", "rpmlib(FileDigests)", "rpmlib(PayloadFilesHavePrefix)"}
+	requireVersions := []string{"3.0.4-1", "4.6.0-1", "4.0-1"}
+	if strings.Contains(version, "~") {
+		requireNames = append(requireNames, "rpmlib(TildeInVersions)")
+		requireVersions = append(requireVersions, "4.10.0-1")
+	}
+	requireFlags := make([]int32, len(requireNames))
+	for i := range requireFlags {
+		requireFlags[i] = rpmRequireRPMLibs
+	}
+	hostname, _ := os.Hostname()
+
+	h := new(rpmHeader)
+	h.add(rpmTagHeaderI18NTable, rpmTypeStringArray, []string{"C"})
+	h.add(rpmTagName, rpmTypeString, pkgName)
+	h.add(rpmTagVersion, rpmTypeString, version)
+	h.add(rpmTagRelease, rpmTypeString, rpmRelease)
+	h.add(rpmTagSummary, rpmTypeI18NString, "Caddy web server (custom build)")
+	h.add(rpmTagDescription, rpmTypeI18NString, b.packageDescription())
+	h.add(rpmTagBuildTime, rpmTypeInt32, []int32{mtime})
+	h.add(rpmTagBuildHost, rpmTypeString, hostname)
+	h.add(rpmTagSize, rpmTypeInt32, []int32{totalSize})
+	h.add(rpmTagLicense, rpmTypeString, "ASL 2.0")
+	h.add(rpmTagPackager, rpmTypeString, PackageMaintainer)
+	h.add(rpmTagGroup, rpmTypeI18NString, "Applications/Internet")
+	h.add(rpmTagURL, rpmTypeString, "https://caddyserver.com")
+	h.add(rpmTagOS, rpmTypeString, "linux")
+	h.add(rpmTagArch, rpmTypeString, arch)
+	h.add(rpmTagFileSizes, rpmTypeInt32, sizes)
+	h.add(rpmTagFileModes, rpmTypeInt16, modes)
+	h.add(rpmTagFileRDevs, rpmTypeInt16, rdevs)
+	h.add(rpmTagFileMTimes, rpmTypeInt32, mtimes)
+	h.add(rpmTagFileDigests, rpmTypeStringArray, digests)
+	h.add(rpmTagFileLinkTos, rpmTypeStringArray, empties)
+	h.add(rpmTagFileFlags, rpmTypeInt32, flags)
+	h.add(rpmTagFileUserName, rpmTypeStringArray, roots)
+	h.add(rpmTagFileGroupName, rpmTypeStringArray, roots)
+	h.add(rpmTagSourceRPM, rpmTypeString, fmt.Sprintf("%s-%s-%s.src.rpm", pkgName, version, rpmRelease))
+	h.add(rpmTagFileVerifyFlags, rpmTypeInt32, verifyFlags)
+	h.add(rpmTagProvideName, rpmTypeStringArray, []string{pkgName, pkgName + "(" + arch + ")"})
+	h.add(rpmTagRequireFlags, rpmTypeInt32, requireFlags)
+	h.add(rpmTagRequireName, rpmTypeStringArray, requireNames)
+	h.add(rpmTagRequireVersion, rpmTypeStringArray, requireVersions)
+	h.add(rpmTagFileDevices, rpmTypeInt32, devices)
+	h.add(rpmTagFileInodes, rpmTypeInt32, inodes)
+	h.add(rpmTagFileLangs, rpmTypeStringArray, empties)
+	h.add(rpmTagProvideFlags, rpmTypeInt32, []int32{rpmSenseEqual, rpmSenseEqual})
+	h.add(rpmTagProvideVersion, rpmTypeStringArray, []string{version + "-" + rpmRelease, version + "-" + rpmRelease})
+	h.add(rpmTagDirIndexes, rpmTypeInt32, dirIndexes)
+	h.add(rpmTagBaseNames, rpmTypeStringArray, baseNames)
+	h.add(rpmTagDirNames, rpmTypeStringArray, dirNames)
+	h.add(rpmTagPayloadFormat, rpmTypeString, "cpio")
+	h.add(rpmTagPayloadCompressor, rpmTypeString, "gzip")
+	h.add(rpmTagPayloadFlags, rpmTypeString, "9")
+	h.add(rpmTagFileDigestAlgo, rpmTypeInt32, []int32{rpmDigestSHA256})
+	h.add(rpmTagPayloadDigest, rpmTypeStringArray, []string{hex.EncodeToString(payloadDigest[:])})
+	h.add(rpmTagPayloadDigestAlgo, rpmTypeInt32, []int32{rpmDigestSHA256})
+	header := h.bytes(rpmTagHeaderImmutable)
+
+	// The signature header has the digests of the rest
+	headerSHA1 := sha1.Sum(header)
+	headerSHA256 := sha256.Sum256(header)
+	md5sum := md5.New()
+	md5sum.Write(header)
+	md5sum.Write(payload.Bytes())
+	sig := new(rpmHeader)
+	sig.add(rpmSigTagSHA1, rpmTypeString, hex.EncodeToString(headerSHA1[:]))
+	sig.add(rpmSigTagSHA256, rpmTypeString, hex.EncodeToString(headerSHA256[:]))
+	sig.add(rpmSigTagSize, rpmTypeInt32, []int32{int32(len(header) + payload.Len())})
+	sig.add(rpmSigTagMD5, rpmTypeBin, md5sum.Sum(nil))
+	sig.add(rpmSigTagPayloadSize, rpmTypeInt32, []int32{int32(cpio.Len())})
+	signature := sig.bytes(rpmTagHeaderSignatures)
+	if pad := len(signature) % 8; pad != 0 {
+		signature = append(signature, make([]byte, 8-pad)...)
+	}
+
+	var pkg bytes.Buffer
+	pkg.Write(rpmLead(fmt.Sprintf("%s-%s-%s", pkgName, version, rpmRelease)))
+	pkg.Write(signature)
+	pkg.Write(header)
+	pkg.Write(payload.Bytes())
+	return ioutil.WriteFile(dest, pkg.Bytes(), 0644)
+}
+
+// rpmLead returns the lead of a binary RPM package for Linux
+// with the given name. RPM ignores most of it these days.
+func rpmLead(name string) []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0}) // magic and version 3.0
+	// type (binary) and arch are 0
+	copy(lead[10:75], name)                  // NUL-terminated
+	binary.BigEndian.PutUint16(lead[76:], 1) // OS: Linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // signature type: header
+	return lead
+}
+
+// rpmEntry is a tag in an RPM header.
+type rpmEntry struct {
+	tag, typ int32
+	value    interface{}
+}
+
+// rpmHeader is an RPM header under construction.
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+// add adds the tag with the type typ and value to h. The
+// value is a string for string types, []byte for binary
+// data, and a slice of the right type otherwise.
+func (h *rpmHeader) add(tag, typ int32, value interface{}) {
+	h.entries = append(h.entries, rpmEntry{tag, typ, value})
+}
+
+// bytes returns h as an immutable region with the given tag,
+// the way RPM stores headers.
+func (h *rpmHeader) bytes(regionTag int32) []byte {
+	sort.SliceStable(h.entries, func(i, j int) bool {
+		return h.entries[i].tag < h.entries[j].tag
+	})
+
+	var index, data bytes.Buffer
+	writeIndex := func(tag, typ, offset, count int32) {
+		binary.Write(&index, binary.BigEndian, []int32{tag, typ, offset, count})
+	}
+	align := func(n int) {
+		for data.Len()%n != 0 {
+			data.WriteByte(0)
+		}
+	}
+
+	for _, e := range h.entries {
+		switch v := e.value.(type) {
+		case string:
+			writeIndex(e.tag, e.typ, int32(data.Len()), 1)
+			data.WriteString(v + "\x00")
+		case []string:
+			writeIndex(e.tag, e.typ, int32(data.Len()), int32(len(v)))
+			for _, s := range v {
+				data.WriteString(s + "\x00")
+			}
+		case []byte:
+			writeIndex(e.tag, e.typ, int32(data.Len()), int32(len(v)))
+			data.Write(v)
+		case []int16:
+			align(2)
+			writeIndex(e.tag, e.typ, int32(data.Len()), int32(len(v)))
+			binary.Write(&data, binary.BigEndian, v)
+		case []int32:
+			align(4)
+			writeIndex(e.tag, e.typ, int32(data.Len()), int32(len(v)))
+			binary.Write(&data, binary.BigEndian, v)
+		}
+	}
+
+	// The region tag comes first in the index, and its data
+	// is a copy of its index entry, but with the negated size
+	// of the index as the offset, at the end of the data.
+	il := int32(len(h.entries) + 1)
+	trailerOffset := int32(data.Len())
+	binary.Write(&data, binary.BigEndian, []int32{regionTag, rpmTypeBin, -il * 16, 16})
+
+	var out bytes.Buffer
+	out.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&out, binary.BigEndian, []int32{il, int32(data.Len())})
+	binary.Write(&out, binary.BigEndian, []int32{regionTag, rpmTypeBin, trailerOffset, 16})
+	out.Write(index.Bytes())
+	out.Write(data.Bytes())
+	return out.Bytes()
+}
+
+// writeCPIOEntry writes a file to a cpio archive in
+// the "new ASCII" format, which is what RPM uses.
+func writeCPIOEntry(buf *bytes.Buffer, name string, inode, mode, mtime uint32, data []byte) {
+	nlink := 1
+	fmt.Fprintf(buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		inode, mode, 0, 0, nlink, mtime, len(data), 0, 0, 0, 0, len(name)+1, 0)
+	buf.WriteString(name + "\x00")
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+	buf.Write(data)
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
@@ -1,82 +1,96 @@
 package server
 
 import (
-	"log"
 	"net/http"
 	"sync"
+	"time"
 )
 
 const (
-	// BuildPath is the path to the builds. The directory is fully
-	// managed, so just choose one that is solely for builds; it
-	// may get deleted.
-	BuildPath = "builds"
-
-	// BuildExpiry is how long builds live before being deleted.
-	// The build server used to update its own dependencies by
-	// running go get -u before builds, but we found out this was
-	// a bad idea, so now I just manually update dependencies by
-	// deleting the package folder and running go get (without -u).
-	// Since the build server has to be taken offline to perform
-	// these updates anyway, we don't have a need to expire the
-	// builds anymore, as long the builds folder is empty when
-	// the build server is restarted. So this used to be 24 hours,
-	// but now is 0. This is especially useful since Go 1.5 and 1.6
-	// got longer build times.
-	BuildExpiry = 0
+	// FailedJobExpiry is how long the status of a failed build
+	// job can be queried through the API before it is forgotten.
+	FailedJobExpiry = 1 * time.Hour
 
 	// MainCaddyPackage is the canonical package name of Caddy's main.
 	MainCaddyPackage = "github.com/mholt/caddy"
 )
 
 var (
+	// BuildPath is the path to the builds. The directory is fully
+	// managed, so just choose one that is solely for builds; it
+	// may get deleted.
+	BuildPath = "builds"
+
+	// allowed are the platforms that builds can be made for,
+	// unless configured otherwise with LoadPlatforms.
 	// See https://golang.org/doc/install/source#environment
 	// Commented builds are problematic.
-	allowed = combos{
-		{os: "darwin", arch: "386"},
-		{os: "darwin", arch: "amd64"},
-		{os: "darwin", arch: "arm"},
-		//{os: "darwin", arch: "arm64"},
-		//{os: "dragonfly", arch: "amd64"},
-		{os: "freebsd", arch: "386"},
-		{os: "freebsd", arch: "amd64"},
-		{os: "freebsd", arch: "arm"},
-		{os: "linux", arch: "386"},
-		{os: "linux", arch: "amd64"},
-		{os: "linux", arch: "arm"},
-		{os: "linux", arch: "arm64"},
-		{os: "linux", arch: "ppc64"},
-		{os: "linux", arch: "ppc64le"},
-		{os: "linux", arch: "mips64"},
-		//{os: "linux", arch: "mips64le"},
-		{os: "netbsd", arch: "386"},
-		{os: "netbsd", arch: "amd64"},
-		{os: "netbsd", arch: "arm"},
-		{os: "openbsd", arch: "386"},
-		{os: "openbsd", arch: "amd64"},
-		{os: "openbsd", arch: "arm"},
-		//{os: "plan9", arch: "386"},
-		//{os: "plan9", arch: "amd64"},
-		{os: "solaris", arch: "amd64"},
-		{os: "windows", arch: "386"},
-		{os: "windows", arch: "amd64"},
-	}
+	allowed = Platforms{
+		{OS: "darwin", Arch: "386"},
+		{OS: "darwin", Arch: "amd64"},
+		{OS: "darwin", Arch: "arm"},
+		//{OS: "darwin", Arch: "arm64"},
+		//{OS: "dragonfly", Arch: "amd64"},
+		{OS: "freebsd", Arch: "386"},
+		{OS: "freebsd", Arch: "amd64"},
+		{OS: "freebsd", Arch: "arm"},
+		{OS: "linux", Arch: "386"},
+		{OS: "linux", Arch: "amd64"},
+		{OS: "linux", Arch: "arm"},
+		{OS: "linux", Arch: "arm64"},
+		{OS: "linux", Arch: "ppc64"},
+		{OS: "linux", Arch: "ppc64le"},
+		{OS: "linux", Arch: "mips64"},
+		//{OS: "linux", Arch: "mips64le"},
+		{OS: "netbsd", Arch: "386"},
+		{OS: "netbsd", Arch: "amd64"},
+		{OS: "netbsd", Arch: "arm"},
+		{OS: "openbsd", Arch: "386"},
+		{OS: "openbsd", Arch: "amd64"},
+		{OS: "openbsd", Arch: "arm"},
+		//{OS: "plan9", Arch: "386"},
+		//{OS: "plan9", Arch: "amd64"},
+		{OS: "solaris", Arch: "amd64"},
+		{OS: "windows", Arch: "386"},
+		{OS: "windows", Arch: "amd64"},
+	}.withDefaults()
+
+	// BuildExpiry is how long finished builds live before being
+	// deleted, no matter how recently they were downloaded; 0
+	// means they don't expire. It used to be 24 hours, back when
+	// the build server ran go get -u before builds. Dependencies
+	// are updated by hand now, and builds made from sources that
+	// have since changed are discarded when the server restarts,
+	// so builds don't need to expire; CacheQuota keeps disk usage
+	// in check instead, evicting the least recently downloaded
+	// builds first. That saves rebuilding popular builds, which
+	// has been getting slower with every Go release.
+	BuildExpiry time.Duration
+
+	// CacheQuota is the maximum total size, in bytes, of the
+	// finished builds kept on disk. When it is exceeded, the
+	// least recently downloaded builds are deleted. 0 means
+	// no limit.
+	CacheQuota int64
 
 	allowedARM = list{"5", "6", "7"}
 	defaultARM = 7
 
-	builds      = make(map[string]*Build)
-	buildsMutex sync.Mutex // protects the builds map
+	builds      = make(map[string]*Build) // keyed by build hash
+	jobs        = make(map[string]*Build) // keyed by job ID
+	buildsMutex sync.Mutex                // protects the builds and jobs maps
 
 	// Path to the caddy project repository
 	CaddyPath string
 )
 
 func handleError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	kv := []interface{}{"request_id", requestID(r), "status", status, "method", r.Method, "url", r.URL.String(), "error", err}
 	if status >= 500 {
-		log.Printf("[%d %s] %v", status, r.URL.String(), err)
+		logError("request failed", kv...)
 		http.Error(w, http.StatusText(status), status)
 	} else {
+		logDebug("request rejected", kv...)
 		http.Error(w, err.Error(), status)
 	}
 }
@@ -91,18 +105,3 @@ func (l list) contains(target string) bool {
 	}
 	return false
 }
-
-type combos []platform
-
-func (c combos) valid(os, arch string) bool {
-	for _, pl := range c {
-		if pl.os == os && pl.arch == arch {
-			return true
-		}
-	}
-	return false
-}
-
-type platform struct {
-	os, arch string
-}
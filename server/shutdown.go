@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// Shutdown stops the build server from taking new build jobs,
+// fails the jobs that are still waiting for a worker, and waits
+// for the running jobs to finish or for ctx to be done, in which
+// case it returns ctx.Err(). Downloads aren't tracked here; shut
+// down the HTTP server (with http.Server.Shutdown) at the same
+// time to wait for those, then call Cleanup.
+func Shutdown(ctx context.Context) error {
+	queue.close()
+	logInfo("waiting for running builds to finish")
+	err := queue.wait(ctx)
+	if err != nil {
+		logWarn("not all builds finished before shutting down", "error", err)
+	}
+	return err
+}
+
+// Cleanup cleans up BuildPath before the build server exits:
+// finished builds are kept or evicted according to BuildExpiry
+// and CacheQuota, as at any other time, and the files of builds
+// that didn't finish are deleted.
+func Cleanup() {
+	evictBuilds(nil)
+
+	buildsMutex.Lock()
+	var unfinished []*Build
+	for _, b := range jobs {
+		if b.State() != JobSucceeded {
+			unfinished = append(unfinished, b)
+		}
+	}
+	buildsMutex.Unlock()
+	for _, b := range unfinished {
+		logInfo("deleting unfinished build", append(b.logFields(), "state", b.State())...)
+		if err := os.RemoveAll(filepath.Dir(b.DownloadFile)); err != nil {
+			logError("deleting build", "hash", b.Hash, "error", err)
+		}
+	}
+}
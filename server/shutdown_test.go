@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// blockingBuilder is a FakeBuilder that waits
+// for release to be closed before building.
+type blockingBuilder struct {
+	release chan struct{}
+}
+
+func (bb blockingBuilder) Build(target Target, outputFile string, log io.Writer) error {
+	<-bb.release
+	return FakeBuilder{}.Build(target, outputFile, log)
+}
+
+func TestShutdown(t *testing.T) {
+	defer useFakeBuilds(t)()
+	release := make(chan struct{})
+	DefaultBuilder = blockingBuilder{release}
+
+	oldQueue, oldWorkers := queue, Workers
+	queue, Workers = &buildQueue{}, 1
+	defer func() { queue, Workers = oldQueue, oldWorkers }()
+
+	queuedDurations := durationCount("windows", "amd64")
+	running, _ := reserveBuild("linux", "amd64", "", "", nil)
+	queued, _ := reserveBuild("windows", "amd64", "", "", nil)
+	for _, b := range []*Build{running, queued} {
+		if err := queue.enqueue(b); err != nil {
+			t.Fatalf("Expected no error queueing build, got %v", err)
+		}
+		defer deleteBuildJob(b.Hash)
+	}
+	for running.State() != JobRunning {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the running build doesn't finish in time
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err := Shutdown(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded, got %v", err)
+	}
+	if queued.State() != JobFailed || queued.Err() != errShuttingDown {
+		t.Errorf("Expected queued build to fail with errShuttingDown, got %s (%v)", queued.State(), queued.Err())
+	}
+	if n := durationCount("windows", "amd64"); n != queuedDurations {
+		t.Errorf("Expected no duration observed for a build that never started, got %d more", n-queuedDurations)
+	}
+	late, _ := reserveBuild("darwin", "amd64", "", "", nil)
+	defer deleteBuildJob(late.Hash)
+	if err := queue.enqueue(late); err != errShuttingDown {
+		t.Errorf("Expected errShuttingDown queueing after shutdown, got %v", err)
+	}
+
+	// until it is let go
+	close(release)
+	err = Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Expected no error once builds are done, got %v", err)
+	}
+	if running.State() != JobSucceeded {
+		t.Errorf("Expected running build to finish, got %s (%v)", running.State(), running.Err())
+	}
+
+	os.MkdirAll(filepath.Dir(queued.DownloadFile), 0755)
+	Cleanup()
+	if _, err := os.Stat(running.DownloadFile); err != nil {
+		t.Errorf("Expected finished build to be kept, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(queued.DownloadFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected unfinished build to be deleted, got %v", err)
+	}
+}
+
+// durationCount returns how many build durations
+// have been observed for the platform.
+func durationCount(goOS, goArch string) uint64 {
+	buildDuration.mu.Lock()
+	defer buildDuration.mu.Unlock()
+	if s, ok := buildDuration.series[goOS+"\xff"+goArch]; ok {
+		return s.count
+	}
+	return 0
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	// signingKey, if set, is used to sign every build.
+	signingKey ed25519.PrivateKey
+
+	// signingKeyID identifies signingKey in signatures.
+	signingKeyID [8]byte
+)
+
+// LoadSigningKey loads the ed25519 private key in the PEM-encoded
+// PKCS #8 file at path (as made by "openssl genpkey -algorithm
+// ed25519"). From then on, every build is signed with it, and
+// the signature is written next to the build with a .minisig
+// extension. Signatures can be verified with minisign and the
+// public key served by SigningKeyHandler.
+func LoadSigningKey(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("%s: no PEM data found", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("%s: not an ed25519 key", path)
+	}
+
+	signingKey = edKey
+	sum := sha256.Sum256(edKey.Public().(ed25519.PublicKey))
+	copy(signingKeyID[:], sum[:])
+	return nil
+}
+
+// SigningKeyHandler serves the public key that builds are
+// signed with, in minisign's format.
+func SigningKeyHandler(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r)
+	if signingKey == nil {
+		handleError(w, r, errors.New("builds are not signed"), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "untrusted comment: minisign public key %X\n%s\n",
+		reverse(signingKeyID[:]), minisignBlob(signingKey.Public().(ed25519.PublicKey)))
+}
+
+// checksumFile computes the SHA-256 digest of the file at path
+// and writes it next to the file with a .sha256 extension, in
+// the format of sha256sum. It returns the hex-encoded digest.
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	line := sum + "  " + filepath.Base(path) + "\n"
+	err = ioutil.WriteFile(path+".sha256", []byte(line), 0644)
+	if err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// digestHeader returns the value of a Digest header (RFC 3230)
+// for the hex-encoded SHA-256 checksum sum.
+func digestHeader(sum string) string {
+	raw, err := hex.DecodeString(sum)
+	if err != nil || len(raw) == 0 {
+		return ""
+	}
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(raw)
+}
+
+// etag returns a strong entity tag for a file with the
+// hex-encoded SHA-256 checksum sum.
+func etag(sum string) string {
+	if sum == "" {
+		return ""
+	}
+	return `"sha256-` + sum + `"`
+}
+
+// signFile signs the file at path with signingKey and writes
+// the signature next to it with a .minisig extension. It returns
+// the path of the signature, or "" if there is no signing key.
+func signFile(path string) (string, error) {
+	if signingKey == nil {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	sig := ed25519.Sign(signingKey, data)
+	trusted := "timestamp:" + strconv.FormatInt(time.Now().Unix(), 10) + "\tfile:" + filepath.Base(path)
+	globalSig := ed25519.Sign(signingKey, append(append([]byte{}, sig...), trusted...))
+
+	out := fmt.Sprintf("untrusted comment: signature from buildsrv secret key\n%s\ntrusted comment: %s\n%s\n",
+		minisignBlob(sig), trusted, base64.StdEncoding.EncodeToString(globalSig))
+	err = ioutil.WriteFile(path+".minisig", []byte(out), 0644)
+	if err != nil {
+		return "", err
+	}
+	return path + ".minisig", nil
+}
+
+// minisignBlob encodes data the way minisign does: prefixed
+// by the algorithm and the key ID, base64-encoded. Data is
+// signed as-is (not prehashed), which minisign calls "Ed".
+func minisignBlob(data []byte) string {
+	blob := append([]byte("Ed"), signingKeyID[:]...)
+	return base64.StdEncoding.EncodeToString(append(blob, data...))
+}
+
+// reverse returns a reversed copy of b. minisign
+// displays key IDs as little-endian numbers.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChecksumFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "caddy.zip")
+	ioutil.WriteFile(path, []byte("hello"), 0644)
+
+	sum, err := checksumFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if sum != expected {
+		t.Errorf("Expected checksum %s, got %s", expected, sum)
+	}
+	sidecar, _ := ioutil.ReadFile(path + ".sha256")
+	if string(sidecar) != expected+"  caddy.zip\n" {
+		t.Errorf("Expected sha256sum-style sidecar file, got '%s'", sidecar)
+	}
+	if header := digestHeader(sum); header != "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("Unexpected Digest header: %s", header)
+	}
+}
+
+func TestSignFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { signingKey = nil }()
+
+	// No key, no signature
+	path := filepath.Join(dir, "caddy.zip")
+	ioutil.WriteFile(path, []byte("hello"), 0644)
+	if sigFile, err := signFile(path); sigFile != "" || err != nil {
+		t.Errorf("Expected no signature without a key, got '%s' (error: %v)", sigFile, err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "signing.key")
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err := LoadSigningKey(keyFile); err != nil {
+		t.Fatalf("Expected no error loading key, got %v", err)
+	}
+
+	sigFile, err := signFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error signing, got %v", err)
+	}
+	contents, _ := ioutil.ReadFile(sigFile)
+	lines := strings.Split(string(contents), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected 4 lines in signature file, got: %q", contents)
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(blob) != 2+8+ed25519.SignatureSize {
+		t.Fatalf("Malformed signature line: %s", lines[1])
+	}
+	if string(blob[:2]) != "Ed" || string(blob[2:10]) != string(signingKeyID[:]) {
+		t.Error("Expected signature to be prefixed by algorithm and key ID")
+	}
+	sig := blob[10:]
+	if !ed25519.Verify(pub, []byte("hello"), sig) {
+		t.Error("Expected signature to verify, but it didn't")
+	}
+
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	globalSig, _ := base64.StdEncoding.DecodeString(lines[3])
+	if !ed25519.Verify(pub, append(sig, trusted...), globalSig) {
+		t.Error("Expected global signature to verify, but it didn't")
+	}
+}
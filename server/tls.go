@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificate is a TLS certificate loaded from a certificate
+// file and a key file, which can be reloaded while it is in
+// use. It is safe for concurrent use.
+type Certificate struct {
+	CertFile, KeyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // latest of the files' when they were loaded
+}
+
+// LoadCertificate loads the certificate in certFile with the
+// key in keyFile.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{CertFile: certFile, KeyFile: keyFile}
+	return c, c.Reload()
+}
+
+// Reload loads the certificate from its files again. If that
+// fails, the certificate that was loaded before is kept.
+func (c *Certificate) Reload() error {
+	modTime := c.filesModTime()
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cert, c.modTime = &cert, modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// filesModTime returns the latest modification time
+// of the certificate and key files.
+func (c *Certificate) filesModTime() time.Time {
+	var latest time.Time
+	for _, file := range []string{c.CertFile, c.KeyFile} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Watch reloads the certificate whenever the modification
+// time of either file changes, checking every interval, so
+// renewed certificates are used without a restart. It returns
+// when stop is closed; a nil stop watches forever. If the
+// certificate can't be loaded, the error is logged once and
+// the current one is kept until the files change again.
+func (c *Certificate) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		modTime := c.filesModTime()
+		changed := !modTime.Equal(c.modTime)
+		c.modTime = modTime // so a broken file isn't retried
+		c.mu.Unlock()
+		if !changed {
+			continue
+		}
+		err := c.Reload()
+		if err != nil {
+			logError("reloading certificate", "cert", c.CertFile, "key", c.KeyFile, "error", err)
+			continue
+		}
+		logInfo("reloaded certificate", "cert", c.CertFile, "key", c.KeyFile)
+	}
+}
+
+// GetCertificate returns the current certificate, for use
+// in tls.Config.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// TLSConfig returns a TLS configuration that serves c and
+// offers HTTP/2.
+func (c *Certificate) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+// RedirectHandler redirects requests to the same URL over HTTPS,
+// at the port of httpsAddr, the address HTTPS is served on.
+func RedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+			host = "[" + host + "]" // IPv6
+		}
+		u := *r.URL
+		u.Scheme, u.Host = "https", host
+
+		// clients keep the method and body for 308, but not
+		// all of them know it, so GETs get the classic 301
+		status := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, u.String(), status)
+	})
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a new self-signed certificate for
+// localhost with the given common name to certFile and keyFile.
+func writeCertificate(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commonName returns the common name of c's current certificate.
+func commonName(t *testing.T, c *Certificate) string {
+	cert, err := c.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	_, err = LoadCertificate(certFile, keyFile)
+	if err == nil {
+		t.Error("Expected an error loading missing files, got none")
+	}
+
+	writeCertificate(t, certFile, keyFile, "first")
+	c, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := commonName(t, c); name != "first" {
+		t.Errorf("Expected certificate 'first', got '%s'", name)
+	}
+
+	// a broken certificate keeps the one loaded before
+	err = ioutil.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Error("Expected an error reloading a broken certificate, got none")
+	}
+	if name := commonName(t, c); name != "first" {
+		t.Errorf("Expected certificate 'first' to be kept, got '%s'", name)
+	}
+
+	// a renewed certificate is picked up by Watch
+	writeCertificate(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.Watch(10*time.Millisecond, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	for start := time.Now(); commonName(t, c) != "second"; {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Expected certificate 'second' to be loaded by Watch, but it wasn't")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTLSConfigHTTP2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buildsrv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "localhost")
+	c, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Proto", r.Proto)
+		}),
+		TLSConfig: c.TLSConfig(),
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pemBytes, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.AppendCertsFromPEM(pemBytes)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2, got %s", resp.Proto)
+	}
+	if proto := resp.Header.Get("X-Proto"); proto != "HTTP/2.0" {
+		t.Errorf("Expected the handler to see HTTP/2.0, got %s", proto)
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for i, test := range []struct {
+		httpsAddr, method, url string
+		expectStatus           int
+		expectLocation         string
+	}{
+		{":443", "GET", "http://example.com/download/build?os=linux", http.StatusMovedPermanently, "https://example.com/download/build?os=linux"},
+		{":443", "HEAD", "http://example.com:80/features.json", http.StatusMovedPermanently, "https://example.com/features.json"},
+		{":5050", "GET", "http://example.com:8080/", http.StatusMovedPermanently, "https://example.com:5050/"},
+		{"0.0.0.0:8443", "POST", "http://example.com/api/builds", http.StatusPermanentRedirect, "https://example.com:8443/api/builds"},
+		{":443", "POST", "http://[::1]:80/api/builds", http.StatusPermanentRedirect, "https://[::1]/api/builds"},
+	} {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		rec := httptest.NewRecorder()
+		RedirectHandler(test.httpsAddr).ServeHTTP(rec, req)
+		if rec.Code != test.expectStatus {
+			t.Errorf("Test %d: Expected status %d, got %d", i, test.expectStatus, rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != test.expectLocation {
+			t.Errorf("Test %d: Expected Location '%s', got '%s'", i, test.expectLocation, loc)
+		}
+	}
+}